@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+const (
+	MAIL_ATTACHMENT_MAX_BYTES  = 10 * 1024 * 1024
+	MAIL_ATTACHMENTS_MAX_BYTES = 25 * 1024 * 1024
+	MAIL_ATTACHMENT_TYPES      = "application/pdf,image/png,image/jpeg,image/gif,text/plain,text/csv"
+	MAIL_ATTACHMENT_MODE       = "base64"
+	MAIL_ATTACHMENT_DIR        = "attachments"
+	MAIL_ATTACHMENT_TTL        = "1h"
+)
+
+// attachmentType is a file forwarded to the mail service, either inline
+// as base64 or as a URL the mail service can fetch it from.
+type attachmentType struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+	Data        string `json:"data,omitempty"`
+	URL         string `json:"url,omitempty"`
+}
+
+type attachmentLimits struct {
+	maxFile  int64
+	maxTotal int64
+	types    map[string]bool
+	mode     string
+	dir      string
+	baseURL  string
+	ttl      time.Duration
+}
+
+func loadAttachmentLimits() (*attachmentLimits, error) {
+	maxFile, err := getEnvInt("MAIL_ATTACHMENT_MAX_BYTES", MAIL_ATTACHMENT_MAX_BYTES)
+	if err != nil {
+		return nil, err
+	}
+	maxTotal, err := getEnvInt("MAIL_ATTACHMENTS_MAX_BYTES", MAIL_ATTACHMENTS_MAX_BYTES)
+	if err != nil {
+		return nil, err
+	}
+	ttl, err := getEnvDuration("MAIL_ATTACHMENT_TTL", MAIL_ATTACHMENT_TTL)
+	if err != nil {
+		return nil, err
+	}
+	limits := &attachmentLimits{
+		maxFile:  int64(maxFile),
+		maxTotal: int64(maxTotal),
+		types:    make(map[string]bool),
+		mode:     getEnv("MAIL_ATTACHMENT_MODE", MAIL_ATTACHMENT_MODE),
+		dir:      getEnv("MAIL_ATTACHMENT_DIR", MAIL_ATTACHMENT_DIR),
+		baseURL:  strings.TrimSuffix(os.Getenv("MAIL_ATTACHMENT_BASE_URL"), "/"),
+		ttl:      ttl,
+	}
+	for _, t := range strings.Split(getEnv("MAIL_ATTACHMENT_TYPES", MAIL_ATTACHMENT_TYPES), ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			limits.types[t] = true
+		}
+	}
+	switch limits.mode {
+	case "base64":
+	case "store":
+		if limits.baseURL == "" {
+			return nil, errors.New("MAIL_ATTACHMENT_BASE_URL is required when MAIL_ATTACHMENT_MODE is store")
+		}
+		if err := os.MkdirAll(limits.dir, 0o700); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("invalid MAIL_ATTACHMENT_MODE %q", limits.mode)
+	}
+	return limits, nil
+}
+
+// readMailForm streams a multipart/form-data send request. The mail
+// fields come either as a "send" part holding the JSON of a send action
+// or as individual from, from_name, to, subject and body fields; every
+// part with a filename is an attachment.
+func (c *Config) readMailForm(w http.ResponseWriter, r *http.Request) (sendType, error) {
+	var request sendType
+	limits := c.attachments
+	// leave room for the form fields next to the files
+	r.Body = http.MaxBytesReader(w, r.Body, limits.maxTotal+1024*1024)
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return request, err
+	}
+
+	var total int64
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return request, err
+		}
+		if part.FileName() == "" {
+			value, err := io.ReadAll(io.LimitReader(part, 1024*1024))
+			if err != nil {
+				return request, err
+			}
+			if err := setMailField(&request, part.FormName(), string(value)); err != nil {
+				return request, err
+			}
+			continue
+		}
+
+		attachment, err := c.readAttachment(part.FileName(), part, limits.maxTotal-total)
+		if err != nil {
+			return request, err
+		}
+		total += attachment.Size
+		request.Files = append(request.Files, attachment)
+	}
+	return request, nil
+}
+
+func setMailField(request *sendType, name, value string) error {
+	switch name {
+	case "send":
+		// only the uploaded parts become files
+		files := request.Files
+		if err := json.Unmarshal([]byte(value), request); err != nil {
+			return err
+		}
+		request.Files = files
+	case "from":
+		request.From = value
+	case "from_name":
+		request.FromName = value
+	case "to":
+		request.To = append(request.To, value)
+	case "cc":
+		request.CC = append(request.CC, value)
+	case "bcc":
+		request.BCC = append(request.BCC, value)
+	case "reply_to":
+		request.ReplyTo = value
+	case "send_at":
+		sendAt, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return errors.New("send_at must be an RFC 3339 timestamp")
+		}
+		request.SendAt = &sendAt
+	case "subject":
+		request.Subject = value
+	case "body":
+		request.Body = value
+	}
+	return nil
+}
+
+// readAttachment reads one file, enforcing the size and type limits,
+// and encodes or stores it depending on MAIL_ATTACHMENT_MODE.
+func (c *Config) readAttachment(filename string, r io.Reader, remaining int64) (attachmentType, error) {
+	limits := c.attachments
+	filename = filepath.Base(filename)
+	limit := limits.maxFile
+	if remaining < limit {
+		limit = remaining
+	}
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return attachmentType{}, err
+	}
+	head = head[:n]
+	contentType, _, _ := mime.ParseMediaType(http.DetectContentType(head))
+	if !limits.types[contentType] {
+		return attachmentType{}, fmt.Errorf("Attachment %s has a type that is not allowed: %s", filename, contentType)
+	}
+	// read one byte past the limit to tell a full file from a cut off one
+	content := io.LimitReader(io.MultiReader(bytes.NewReader(head), r), limit+1)
+	attachment := attachmentType{Filename: filename, ContentType: contentType}
+
+	if limits.mode == "store" {
+		id := newID()
+		file, err := os.OpenFile(filepath.Join(limits.dir, id), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+		if err != nil {
+			return attachment, err
+		}
+		attachment.Size, err = io.Copy(file, content)
+		file.Close()
+		if err == nil && attachment.Size > limit {
+			err = fmt.Errorf("Attachment %s is too large", filename)
+		}
+		if err != nil {
+			os.Remove(file.Name())
+			return attachment, err
+		}
+		attachment.URL = limits.baseURL + "/attachments/" + id
+		return attachment, nil
+	}
+
+	var encoded bytes.Buffer
+	encoder := base64.NewEncoder(base64.StdEncoding, &encoded)
+	attachment.Size, err = io.Copy(encoder, content)
+	encoder.Close()
+	if err != nil {
+		return attachment, err
+	}
+	if attachment.Size > limit {
+		return attachment, fmt.Errorf("Attachment %s is too large", filename)
+	}
+	attachment.Data = encoded.String()
+	return attachment, nil
+}
+
+// handleMail sends an email uploaded as multipart/form-data.
+func (c *Config) handleMail(w http.ResponseWriter, r *http.Request) {
+	request, err := c.readMailForm(w, r)
+	if err != nil {
+		c.ErrorJSON(w, err)
+		return
+	}
+	payload, err := c.runAction(r.Context(), requestType{Action: Send, Send: request})
+	if err != nil {
+		c.ErrorJSON(w, err, http.StatusAccepted)
+		return
+	}
+	c.writeJSON(w, http.StatusAccepted, payload)
+}
+
+// getAttachment serves a stored attachment to the mail service until it
+// expires.
+func (c *Config) getAttachment(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	path := filepath.Join(c.attachments.dir, filepath.Base(id))
+	info, err := os.Stat(path)
+	if err != nil || c.attachments.mode != "store" {
+		c.ErrorJSON(w, errors.New("Attachment not found"), http.StatusNotFound)
+		return
+	}
+	if time.Since(info.ModTime()) > c.attachments.ttl {
+		os.Remove(path)
+		c.ErrorJSON(w, errors.New("Attachment not found"), http.StatusNotFound)
+		return
+	}
+	http.ServeFile(w, r, path)
+}
+
+// sweepAttachments removes stored attachments once they expire.
+func (c *Config) sweepAttachments() {
+	for range time.Tick(c.attachments.ttl / 2) {
+		entries, err := os.ReadDir(c.attachments.dir)
+		if err != nil {
+			log.Println("attachments:", err)
+			continue
+		}
+		for _, entry := range entries {
+			info, err := entry.Info()
+			if err == nil && time.Since(info.ModTime()) > c.attachments.ttl {
+				os.Remove(filepath.Join(c.attachments.dir, entry.Name()))
+			}
+		}
+	}
+}
+
+// checkFiles validates the files of a send request. Only the server
+// fills them in, but they travel in the JSON of the request, so every
+// entry must pass the same checks as an upload: inline files by their
+// content and stored ones against the attachment store.
+func (c *Config) checkFiles(files []attachmentType) error {
+	limits := c.attachments
+	var total int64
+	for _, file := range files {
+		data, err := limits.read(file)
+		if err != nil {
+			return fmt.Errorf("Invalid attachment %s", file.Filename)
+		}
+		size := int64(len(data))
+		total += size
+		if size != file.Size || size > limits.maxFile || total > limits.maxTotal {
+			return fmt.Errorf("Attachment %s is too large", file.Filename)
+		}
+		if file.Filename != filepath.Base(file.Filename) {
+			return fmt.Errorf("Invalid attachment %s", file.Filename)
+		}
+		contentType, _, _ := mime.ParseMediaType(http.DetectContentType(data))
+		if !limits.types[contentType] || contentType != file.ContentType {
+			return fmt.Errorf("Attachment %s has a type that is not allowed: %s", file.Filename, file.ContentType)
+		}
+	}
+	return nil
+}
+
+// read returns the content of an inline attachment, or reads a stored
+// one from the attachment store. URLs that don't point into the store
+// are refused rather than fetched.
+func (limits *attachmentLimits) read(file attachmentType) ([]byte, error) {
+	if file.URL == "" {
+		return base64.StdEncoding.DecodeString(file.Data)
+	}
+	path, err := limits.path(file)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if time.Since(info.ModTime()) > limits.ttl {
+		return nil, errors.New("attachment expired")
+	}
+	if info.Size() > limits.maxFile {
+		return nil, errors.New("attachment too large")
+	}
+	return os.ReadFile(path)
+}
+
+// path returns where a stored attachment is kept in the store.
+func (limits *attachmentLimits) path(file attachmentType) (string, error) {
+	prefix := limits.baseURL + "/attachments/"
+	id := strings.TrimPrefix(file.URL, prefix)
+	if limits.mode != "store" || file.Data != "" || !strings.HasPrefix(file.URL, prefix) || id == "" || id != filepath.Base(id) {
+		return "", errors.New("not a stored attachment")
+	}
+	return filepath.Join(limits.dir, id), nil
+}
+
+// expires returns when a stored attachment is removed from the store.
+func (limits *attachmentLimits) expires(file attachmentType) (time.Time, error) {
+	path, err := limits.path(file)
+	if err != nil {
+		return time.Time{}, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime().Add(limits.ttl), nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckFiles(t *testing.T) {
+	limits := testAttachmentLimits(t, "store")
+	limits.maxFile = 16
+	limits.maxTotal = 24
+	write := func(id, content string, age time.Duration) {
+		path := filepath.Join(limits.dir, id)
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		modified := time.Now().Add(-age)
+		os.Chtimes(path, modified, modified)
+	}
+	write("stored", "stored text", 0)
+	write("expired", "old text", 2*limits.ttl)
+	write("large", strings.Repeat("x", 20), 0)
+	c := &Config{attachments: limits}
+
+	inline := func(name, content string) attachmentType {
+		return attachmentType{Filename: name, ContentType: "text/plain", Size: int64(len(content)), Data: base64.StdEncoding.EncodeToString([]byte(content))}
+	}
+	stored := func(id string, size int64) attachmentType {
+		return attachmentType{Filename: "a.txt", ContentType: "text/plain", Size: size, URL: "http://broker.test/attachments/" + id}
+	}
+	tests := []struct {
+		name    string
+		files   []attachmentType
+		wantErr bool
+	}{
+		{"none", nil, false},
+		{"inline", []attachmentType{inline("a.txt", "hello")}, false},
+		{"stored", []attachmentType{stored("stored", 11)}, false},
+		{"invalid base64", []attachmentType{{Filename: "a.txt", ContentType: "text/plain", Data: "%%%"}}, true},
+		{"wrong size", []attachmentType{{Filename: "a.txt", ContentType: "text/plain", Size: 1, Data: base64.StdEncoding.EncodeToString([]byte("hello"))}}, true},
+		{"file too large", []attachmentType{inline("a.txt", strings.Repeat("x", 17))}, true},
+		{"total too large", []attachmentType{inline("a.txt", strings.Repeat("x", 16)), inline("b.txt", strings.Repeat("x", 16))}, true},
+		{"path in filename", []attachmentType{inline("../a.txt", "hello")}, true},
+		{"type not allowed", []attachmentType{{Filename: "a.html", ContentType: "text/html", Size: 13, Data: base64.StdEncoding.EncodeToString([]byte("<html></html>"))}}, true},
+		{"type differs from content", []attachmentType{{Filename: "a.png", ContentType: "image/png", Size: 5, Data: base64.StdEncoding.EncodeToString([]byte("hello"))}}, true},
+		{"foreign url", []attachmentType{{Filename: "a.txt", ContentType: "text/plain", Size: 5, URL: "http://169.254.169.254/latest"}}, true},
+		{"url escaping the store", []attachmentType{stored("..%2fsecret", 5)}, true},
+		{"unknown stored file", []attachmentType{stored("missing", 5)}, true},
+		{"expired stored file", []attachmentType{stored("expired", 8)}, true},
+		{"stored file too large", []attachmentType{stored("large", 20)}, true},
+	}
+	for _, tt := range tests {
+		if err := c.checkFiles(tt.files); (err != nil) != tt.wantErr {
+			t.Errorf("%s: err = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
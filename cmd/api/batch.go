@@ -0,0 +1,205 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	BATCH_MAX_ITEMS   = 50
+	BATCH_CONCURRENCY = 4
+)
+
+// batchRequest runs several actions in one call. With Queue set the
+// requests are queued instead of executed, and Atomic queues either all
+// of them or none.
+type batchRequest struct {
+	Queue    bool          `json:"queue,omitempty"`
+	Atomic   bool          `json:"atomic,omitempty"`
+	Requests []requestType `json:"requests"`
+}
+
+type batchResult struct {
+	Index   int    `json:"index"`
+	Status  int    `json:"status"`
+	Error   bool   `json:"error"`
+	Message string `json:"message"`
+	Data    any    `json:"data,omitempty"`
+}
+
+func (c *Config) handleBatch(w http.ResponseWriter, r *http.Request) {
+	var batch batchRequest
+	if err := c.readJSON(w, r, &batch); err != nil {
+		c.ErrorJSON(w, err)
+		return
+	}
+	maxItems, err := getEnvInt("BATCH_MAX_ITEMS", BATCH_MAX_ITEMS)
+	if err != nil {
+		c.ErrorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+	if len(batch.Requests) == 0 {
+		c.ErrorJSON(w, errors.New("The batch has no requests"))
+		return
+	}
+	if len(batch.Requests) > maxItems {
+		c.ErrorJSON(w, fmt.Errorf("The batch has more than %d requests", maxItems), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if batch.Queue {
+		c.queueBatch(w, r, batch)
+		return
+	}
+
+	concurrency, err := getEnvInt("BATCH_CONCURRENCY", BATCH_CONCURRENCY)
+	if err != nil {
+		c.ErrorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+	results := make([]batchResult, len(batch.Requests))
+	sem := make(chan struct{}, clamp(concurrency, 1, maxItems))
+	var wg sync.WaitGroup
+	for i, request := range batch.Requests {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, request requestType) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if request.Action == Send {
+				if err := c.validateSend(request.Send); err != nil {
+					results[i] = batchResult{Index: i, Status: http.StatusBadRequest, Error: true, Message: err.Error()}
+					return
+				}
+			}
+			payload, err := c.runAction(r.Context(), request)
+			results[i] = batchResult{Index: i, Status: http.StatusAccepted, Message: payload.Message, Data: payload.Data}
+			switch {
+			case errors.Is(err, errUnknownAction), errors.Is(err, errSuppressed):
+				results[i] = batchResult{Index: i, Status: http.StatusBadRequest, Error: true, Message: err.Error()}
+			case err != nil:
+				results[i] = batchResult{Index: i, Status: http.StatusBadGateway, Error: true, Message: err.Error()}
+			}
+		}(i, request)
+	}
+	wg.Wait()
+
+	c.writeBatch(w, "Batch processed", results)
+}
+
+// writeBatch answers with the results of a batch. When every request
+// failed the batch fails as a whole, with the most severe status of its
+// requests, so it isn't kept for its Idempotency-Key either.
+func (c *Config) writeBatch(w http.ResponseWriter, message string, results []batchResult) {
+	status := 0
+	for _, result := range results {
+		if !result.Error {
+			response := jsonResponse{
+				Error:   false,
+				Message: message,
+				Data:    results,
+			}
+			c.writeJSON(w, http.StatusOK, response)
+			return
+		}
+		if result.Status > status {
+			status = result.Status
+		}
+	}
+	response := jsonResponse{
+		Error:   true,
+		Message: "Every request of the batch failed",
+		Data:    results,
+	}
+	c.writeJSON(w, status, response)
+}
+
+// queueBatch queues every request of the batch as its own job.
+func (c *Config) queueBatch(w http.ResponseWriter, r *http.Request, batch batchRequest) {
+	enc, err := requestCodec(r)
+	if err != nil {
+		c.ErrorJSON(w, err)
+		return
+	}
+
+	results := make([]batchResult, len(batch.Requests))
+	queued := make([]*queuedMessage, len(batch.Requests))
+	failed := false
+	for i, request := range batch.Requests {
+		results[i].Index = i
+		switch request.Action {
+		case Authorization, Logging, Send:
+		default:
+			results[i] = batchResult{Index: i, Status: http.StatusBadRequest, Error: true, Message: errUnknownAction.Error()}
+			failed = true
+			continue
+		}
+		if request.Action == Send {
+			if err := c.validateSend(request.Send); err != nil {
+				results[i] = batchResult{Index: i, Status: http.StatusBadRequest, Error: true, Message: err.Error()}
+				failed = true
+				continue
+			}
+		}
+		msg, err := c.newQueuedMessage(r, request.Action, func(id string) (amqp.Publishing, error) {
+			return newEnvelope(enc, id, c.redactRequest(request))
+		})
+		if err != nil {
+			results[i] = batchResult{Index: i, Status: http.StatusBadRequest, Error: true, Message: err.Error()}
+			failed = true
+			continue
+		}
+		queued[i] = &msg
+	}
+
+	if batch.Atomic {
+		var records []outboxRecord
+		for _, msg := range queued {
+			if msg != nil {
+				records = append(records, msg.record)
+			}
+		}
+		if !failed {
+			err = c.outbox.append(records...)
+		}
+		if failed || err != nil {
+			for i, msg := range queued {
+				if msg != nil {
+					c.jobs.delete(msg.job.ID)
+					results[i] = batchResult{Index: i, Status: http.StatusFailedDependency, Error: true, Message: "Not queued"}
+				}
+			}
+			status := http.StatusBadRequest
+			if err != nil {
+				status = queueErrorStatus(err)
+			}
+			response := jsonResponse{
+				Error:   true,
+				Message: "Nothing was queued",
+				Data:    results,
+			}
+			c.writeJSON(w, status, response)
+			return
+		}
+	}
+
+	for i, msg := range queued {
+		if msg == nil {
+			continue
+		}
+		if !batch.Atomic {
+			if err := c.outbox.append(msg.record); err != nil {
+				c.jobs.delete(msg.job.ID)
+				results[i] = batchResult{Index: i, Status: queueErrorStatus(err), Error: true, Message: "Send to Queue Error!!"}
+				continue
+			}
+		}
+		results[i] = batchResult{Index: i, Status: http.StatusAccepted, Message: "Request Sent to Queue!!", Data: msg.job}
+	}
+
+	c.writeBatch(w, "Batch queued", results)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestHandleBatch(t *testing.T) {
+	sink := newSMTPSink(t)
+	down := newSMTPSink(t)
+	down.listener.Close()
+	t.Setenv("SUPPRESSION_MODE", "reject")
+	c := testWorkerConfig(t, sink)
+	if err := os.WriteFile(c.suppressions.path, []byte(`[{"address":"gone@example.com","reason":"bounce"}]`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	unreachable := testWorkerConfig(t, down)
+	c.outbox = openTestOutbox(t, t.TempDir())
+	var err error
+	if c.jobs, err = newJobStore(); err != nil {
+		t.Fatal(err)
+	}
+
+	const (
+		send       = `{"action":"send","send":{"to":"to@example.com","body":"body"}}`
+		unknown    = `{"action":"unknown"}`
+		invalid    = `{"action":"send","send":{"body":"no recipients"}}`
+		suppressed = `{"action":"send","send":{"to":"gone@example.com","body":"body"}}`
+		logging    = `{"action":"logging","log":{"name":"event","message":"message"}}`
+	)
+	tests := []struct {
+		name     string
+		c        *Config
+		body     string
+		want     int
+		wantErr  bool
+		statuses []int
+	}{
+		{"mixed", c, `{"requests":[` + send + `,` + unknown + `]}`, http.StatusOK, false, []int{202, 400}},
+		{"client errors", c, `{"requests":[` + unknown + `,` + invalid + `,` + suppressed + `]}`, http.StatusBadRequest, true, []int{400, 400, 400}},
+		{"downstream down", unreachable, `{"requests":[` + send + `,` + unknown + `]}`, http.StatusBadGateway, true, []int{502, 400}},
+		{"queued", c, `{"queue":true,"requests":[` + logging + `,` + unknown + `]}`, http.StatusOK, false, []int{202, 400}},
+		{"nothing queued", c, `{"queue":true,"requests":[` + unknown + `,` + invalid + `]}`, http.StatusBadRequest, true, []int{400, 400}},
+		{"atomic", c, `{"queue":true,"atomic":true,"requests":[` + logging + `,` + invalid + `]}`, http.StatusBadRequest, true, []int{424, 400}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/batch", strings.NewReader(tt.body))
+			r.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			tt.c.handleBatch(w, r)
+			if w.Code != tt.want {
+				t.Errorf("got status %d, want %d", w.Code, tt.want)
+			}
+			var response struct {
+				Error bool          `json:"error"`
+				Data  []batchResult `json:"data"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+			if response.Error != tt.wantErr {
+				t.Errorf("got error %v, want %v", response.Error, tt.wantErr)
+			}
+			if len(response.Data) != len(tt.statuses) {
+				t.Fatalf("got %d results, want %d", len(response.Data), len(tt.statuses))
+			}
+			for i, result := range response.Data {
+				if result.Status != tt.statuses[i] {
+					t.Errorf("request %d: got status %d, want %d (%s)", i, result.Status, tt.statuses[i], result.Message)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const CACHE_MAX_BYTES = 32 * 1024 * 1024
+
+type cacheEntry struct {
+	key     string
+	value   any
+	size    int
+	expires time.Time
+}
+
+// responseCache is an LRU cache bounded by the approximate size of its
+// values. Concurrent misses for the same key are collapsed into one
+// call to the upstream.
+type responseCache struct {
+	mu       sync.Mutex
+	maxBytes int
+	size     int
+	ll       *list.List
+	items    map[string]*list.Element
+	flights  map[string]*flight
+
+	hits   *counter
+	misses *counter
+}
+
+type flight struct {
+	wg    sync.WaitGroup
+	value any
+	err   error
+}
+
+func newResponseCache(metrics *metricsRegistry) (*responseCache, error) {
+	maxBytes, err := getEnvInt("CACHE_MAX_BYTES", CACHE_MAX_BYTES)
+	if err != nil {
+		return nil, err
+	}
+	c := &responseCache{
+		maxBytes: maxBytes,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+		flights:  make(map[string]*flight),
+		hits:     metrics.counter("broker_cache_hits_total", "Responses served from the cache."),
+		misses:   metrics.counter("broker_cache_misses_total", "Responses fetched because they were not cached."),
+	}
+	metrics.gauge("broker_cache_bytes", "Approximate size of the cached responses.", func() float64 {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return float64(c.size)
+	})
+	return c, nil
+}
+
+func (c *responseCache) get(key string) (any, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	entry := el.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		c.remove(el)
+		return nil, false
+	}
+	c.ll.MoveToFront(el)
+	return entry.value, true
+}
+
+func (c *responseCache) set(key string, value any, size int, ttl time.Duration) {
+	if ttl <= 0 || size > c.maxBytes {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		c.remove(el)
+	}
+	entry := &cacheEntry{key: key, value: value, size: size, expires: time.Now().Add(ttl)}
+	c.items[key] = c.ll.PushFront(entry)
+	c.size += size
+	for c.size > c.maxBytes {
+		c.remove(c.ll.Back())
+	}
+}
+
+func (c *responseCache) invalidate(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		c.remove(el)
+	}
+}
+
+// remove must be called with c.mu held.
+func (c *responseCache) remove(el *list.Element) {
+	entry := c.ll.Remove(el).(*cacheEntry)
+	delete(c.items, entry.key)
+	c.size -= entry.size
+}
+
+// do returns the cached value for key, or calls fetch once for all the
+// callers waiting on the same key. fetch reports the size and TTL to
+// cache the value with; a zero TTL leaves it uncached.
+func (c *responseCache) do(key string, fetch func() (any, int, time.Duration, error)) (any, bool, error) {
+	if value, ok := c.get(key); ok {
+		c.hits.inc()
+		return value, true, nil
+	}
+	c.misses.inc()
+
+	c.mu.Lock()
+	if f, ok := c.flights[key]; ok {
+		c.mu.Unlock()
+		f.wg.Wait()
+		return f.value, false, f.err
+	}
+	f := &flight{}
+	f.wg.Add(1)
+	c.flights[key] = f
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.flights, key)
+		c.mu.Unlock()
+		f.wg.Done()
+	}()
+	var size int
+	var ttl time.Duration
+	f.value, size, ttl, f.err = c.fetch(fetch)
+	if f.err == nil {
+		c.set(key, f.value, size, ttl)
+	}
+	return f.value, false, f.err
+}
+
+// fetch calls fetch, turning a panic into an error so the callers
+// waiting on the same key aren't left hanging.
+func (c *responseCache) fetch(fetch func() (any, int, time.Duration, error)) (value any, size int, ttl time.Duration, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			log.Printf("cache: panic while fetching: %v\n%s", p, debug.Stack())
+			value, size, ttl, err = nil, 0, 0, errors.New("Upstream request failed")
+		}
+	}()
+	return fetch()
+}
+
+func cacheKey(parts ...string) string {
+	h := sha256.New()
+	for _, part := range parts {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+type cachedResponse struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+// bufferedWriter collects a response in memory.
+type bufferedWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferedWriter) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedWriter) WriteHeader(statusCode int) {
+	if b.status == 0 {
+		b.status = statusCode
+	}
+}
+
+func (b *bufferedWriter) Write(p []byte) (int, error) {
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+	return b.body.Write(p)
+}
+
+// cacheTTL returns how long resp may be cached, honouring the upstream
+// Cache-Control header and falling back to the route TTL.
+func cacheTTL(resp *bufferedWriter, routeTTL time.Duration) time.Duration {
+	if resp.status != http.StatusOK {
+		return 0
+	}
+	ttl := routeTTL
+	for _, directive := range strings.Split(resp.header.Get("Cache-Control"), ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(strings.ToLower(directive)), "=")
+		switch name {
+		case "no-store", "no-cache", "private":
+			return 0
+		case "max-age", "s-maxage":
+			if seconds, err := strconv.Atoi(value); err == nil && time.Duration(seconds)*time.Second < ttl {
+				ttl = time.Duration(seconds) * time.Second
+			}
+		}
+	}
+	if resp.header.Get("Set-Cookie") != "" {
+		return 0
+	}
+	return ttl
+}
+
+// cacheResponses caches GET and HEAD responses of next for up to ttl.
+// The key is the method, path, sorted query and Accept header.
+// Requests with Cache-Control: no-cache skip the lookup, and requests
+// with credentials skip the cache, as their response may be meant for
+// that client only.
+func (c *Config) cacheResponses(ttl time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodGet && r.Method != http.MethodHead || hasCredentials(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			query, _ := url.ParseQuery(r.URL.RawQuery)
+			key := cacheKey("route", r.Method, r.URL.Path, query.Encode(), r.Header.Get("Accept"))
+			if strings.Contains(strings.ToLower(r.Header.Get("Cache-Control")), "no-cache") {
+				c.cache.invalidate(key)
+			}
+
+			value, hit, err := c.cache.do(key, func() (any, int, time.Duration, error) {
+				// the fetch is shared, so it must not be cancelled by one client leaving
+				buffered := &bufferedWriter{header: http.Header{}}
+				next.ServeHTTP(buffered, r.WithContext(context.Background()))
+				resp := cachedResponse{status: buffered.status, header: buffered.header, body: buffered.body.Bytes()}
+				return resp, len(resp.body), cacheTTL(buffered, ttl), nil
+			})
+			if err != nil {
+				c.ErrorJSON(w, err, http.StatusBadGateway)
+				return
+			}
+			resp := value.(cachedResponse)
+			for name, values := range resp.header {
+				w.Header()[name] = values
+			}
+			if hit {
+				w.Header().Set("X-Cache", "HIT")
+			} else {
+				w.Header().Set("X-Cache", "MISS")
+			}
+			w.WriteHeader(resp.status)
+			w.Write(resp.body)
+		})
+	}
+}
+
+// hasCredentials reports whether r identifies its client to the
+// upstream.
+func hasCredentials(r *http.Request) bool {
+	return r.Header.Get("Authorization") != "" || r.Header.Get("Cookie") != ""
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestCache(t *testing.T, maxBytes string) *responseCache {
+	t.Helper()
+	t.Setenv("CACHE_MAX_BYTES", maxBytes)
+	cache, err := newResponseCache(newMetricsRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cache
+}
+
+func TestResponseCacheEviction(t *testing.T) {
+	cache := newTestCache(t, "10")
+	cache.set("a", "a", 4, time.Minute)
+	cache.set("b", "b", 4, time.Minute)
+	cache.get("a")
+	cache.set("c", "c", 4, time.Minute)
+	cache.set("expired", "x", 1, time.Nanosecond)
+	cache.set("huge", "h", 11, time.Minute)
+	time.Sleep(time.Millisecond)
+
+	tests := []struct {
+		key  string
+		want bool
+	}{
+		{"a", true},
+		{"b", false},
+		{"c", true},
+		{"expired", false},
+		{"huge", false},
+	}
+	for _, tt := range tests {
+		if _, ok := cache.get(tt.key); ok != tt.want {
+			t.Errorf("get(%q) = %v, want %v", tt.key, ok, tt.want)
+		}
+	}
+	if cache.size > cache.maxBytes {
+		t.Errorf("size %d over the limit of %d", cache.size, cache.maxBytes)
+	}
+}
+
+func TestResponseCacheCollapsesMisses(t *testing.T) {
+	cache := newTestCache(t, "1024")
+	var calls atomic.Int32
+	release := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			value, _, err := cache.do("key", func() (any, int, time.Duration, error) {
+				calls.Add(1)
+				<-release
+				return "value", 5, time.Minute, nil
+			})
+			if err != nil || value != "value" {
+				t.Errorf("got %v, %v", value, err)
+			}
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if n := calls.Load(); n != 1 {
+		t.Errorf("fetched %d times, want 1", n)
+	}
+}
+
+func TestResponseCacheRecoversPanics(t *testing.T) {
+	cache := newTestCache(t, "1024")
+	started := make(chan struct{})
+	done := make(chan error, 2)
+	go func() {
+		_, _, err := cache.do("key", func() (any, int, time.Duration, error) {
+			close(started)
+			time.Sleep(10 * time.Millisecond)
+			panic("boom")
+		})
+		done <- err
+	}()
+	<-started
+	go func() {
+		_, _, err := cache.do("key", func() (any, int, time.Duration, error) {
+			return "value", 5, time.Minute, nil
+		})
+		done <- err
+	}()
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-done:
+			if i == 0 && err == nil {
+				t.Error("expected the panic as an error")
+			}
+		case <-time.After(time.Second):
+			t.Fatal("caller stuck after a panic")
+		}
+	}
+	if value, _, err := cache.do("key", func() (any, int, time.Duration, error) {
+		return "value", 5, time.Minute, nil
+	}); err != nil || value != "value" {
+		t.Errorf("got %v, %v after the panic", value, err)
+	}
+}
+
+func TestCacheResponses(t *testing.T) {
+	cache := newTestCache(t, "1024")
+	c := &Config{cache: cache}
+	var calls atomic.Int32
+	handler := c.cacheResponses(time.Minute)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Write([]byte("for " + r.Header.Get("Authorization") + r.Header.Get("Cookie")))
+	}))
+
+	tests := []struct {
+		name   string
+		method string
+		header http.Header
+		want   string
+		calls  int32
+	}{
+		{"first request misses", http.MethodGet, nil, "MISS", 1},
+		{"second request hits", http.MethodGet, nil, "HIT", 1},
+		{"authorization skips the cache", http.MethodGet, http.Header{"Authorization": {"Bearer a"}}, "", 2},
+		{"cookie skips the cache", http.MethodGet, http.Header{"Cookie": {"session=b"}}, "", 3},
+		{"no-cache refetches", http.MethodGet, http.Header{"Cache-Control": {"no-cache"}}, "MISS", 4},
+		{"post is not cached", http.MethodPost, nil, "", 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/route?b=2&a=1", nil)
+			for name, values := range tt.header {
+				r.Header[name] = values
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if got := w.Header().Get("X-Cache"); got != tt.want {
+				t.Errorf("X-Cache = %q, want %q", got, tt.want)
+			}
+			if n := calls.Load(); n != tt.calls {
+				t.Errorf("upstream called %d times, want %d", n, tt.calls)
+			}
+		})
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		header http.Header
+		want   time.Duration
+	}{
+		{"route ttl", http.StatusOK, http.Header{}, time.Minute},
+		{"max-age shortens", http.StatusOK, http.Header{"Cache-Control": {"max-age=10"}}, 10 * time.Second},
+		{"max-age doesn't lengthen", http.StatusOK, http.Header{"Cache-Control": {"max-age=600"}}, time.Minute},
+		{"no-store", http.StatusOK, http.Header{"Cache-Control": {"no-store"}}, 0},
+		{"private", http.StatusOK, http.Header{"Cache-Control": {"public, private"}}, 0},
+		{"set-cookie", http.StatusOK, http.Header{"Set-Cookie": {"a=b"}}, 0},
+		{"error", http.StatusBadGateway, http.Header{}, 0},
+	}
+	for _, tt := range tests {
+		resp := &bufferedWriter{header: tt.header, status: tt.status}
+		if got := cacheTTL(resp, time.Minute); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
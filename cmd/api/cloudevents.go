@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	cloudEventsContentType = "application/cloudevents+json"
+	cloudEventsSpecVersion = "1.0"
+	// actions are mapped to event types such as broker.send
+	cloudEventTypePrefix = "broker."
+	// header prefix of the CloudEvents AMQP binding
+	cloudEventsAMQPPrefix = "cloudEvents_"
+)
+
+// cloudEvent holds the attributes and data of a CloudEvent. Extension
+// attributes are kept as strings.
+type cloudEvent struct {
+	SpecVersion     string
+	ID              string
+	Source          string
+	Type            string
+	Subject         string
+	Time            string
+	DataSchema      string
+	DataContentType string
+	Extensions      map[string]string
+	Data            []byte
+}
+
+// isCloudEvent reports whether r carries a CloudEvent in structured or
+// binary content mode.
+func isCloudEvent(r *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mediaType == cloudEventsContentType || r.Header.Get("ce-specversion") != ""
+}
+
+// readCloudEvent parses the CloudEvent in r.
+func readCloudEvent(w http.ResponseWriter, r *http.Request) (*cloudEvent, error) {
+	maxBytes := 1024 * 1024
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, int64(maxBytes)))
+	if err != nil {
+		return nil, err
+	}
+
+	var event *cloudEvent
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == cloudEventsContentType {
+		if event, err = parseStructuredCloudEvent(body); err != nil {
+			return nil, err
+		}
+	} else {
+		event = &cloudEvent{
+			DataContentType: r.Header.Get("Content-Type"),
+			Extensions:      map[string]string{},
+			Data:            body,
+		}
+		for key, values := range r.Header {
+			name := strings.ToLower(key)
+			if !strings.HasPrefix(name, "ce-") || len(values) == 0 {
+				continue
+			}
+			event.set(strings.TrimPrefix(name, "ce-"), values[0])
+		}
+	}
+	return event, event.validate()
+}
+
+func parseStructuredCloudEvent(body []byte) (*cloudEvent, error) {
+	var attributes map[string]json.RawMessage
+	if err := json.Unmarshal(body, &attributes); err != nil {
+		return nil, err
+	}
+	event := &cloudEvent{Extensions: map[string]string{}}
+	for name, raw := range attributes {
+		switch name {
+		case "data":
+			event.Data = raw
+		case "data_base64":
+			var encoded string
+			if err := json.Unmarshal(raw, &encoded); err != nil {
+				return nil, err
+			}
+			data, err := base64.StdEncoding.DecodeString(encoded)
+			if err != nil {
+				return nil, err
+			}
+			event.Data = data
+		default:
+			var value any
+			if err := json.Unmarshal(raw, &value); err != nil {
+				return nil, err
+			}
+			if s, ok := value.(string); ok {
+				event.set(name, s)
+			} else {
+				event.set(name, string(raw))
+			}
+		}
+	}
+	if _, ok := attributes["data"]; ok && event.DataContentType == "" {
+		event.DataContentType = "application/json"
+	}
+	return event, nil
+}
+
+func (e *cloudEvent) set(name, value string) {
+	switch name {
+	case "specversion":
+		e.SpecVersion = value
+	case "id":
+		e.ID = value
+	case "source":
+		e.Source = value
+	case "type":
+		e.Type = value
+	case "subject":
+		e.Subject = value
+	case "time":
+		e.Time = value
+	case "dataschema":
+		e.DataSchema = value
+	case "datacontenttype":
+		e.DataContentType = value
+	default:
+		e.Extensions[name] = value
+	}
+}
+
+func (e *cloudEvent) validate() error {
+	if e.SpecVersion != cloudEventsSpecVersion {
+		return errors.New("Unsupported CloudEvents specversion, 1.0 is needed")
+	}
+	if e.ID == "" || e.Source == "" || e.Type == "" {
+		return errors.New("CloudEvents id, source and type are required")
+	}
+	if e.Time != "" {
+		if _, err := time.Parse(time.RFC3339, e.Time); err != nil {
+			return errors.New("CloudEvents time must be RFC 3339")
+		}
+	}
+	return nil
+}
+
+// action returns the broker action for the event type.
+func (e *cloudEvent) action() string {
+	return actionFromCloudEventType(e.Type)
+}
+
+func actionFromCloudEventType(eventType string) string {
+	return strings.TrimPrefix(eventType, cloudEventTypePrefix)
+}
+
+// publishing maps the event to an AMQP message using the binary content
+// mode of the CloudEvents AMQP binding.
+func (e *cloudEvent) publishing(id string) amqp.Publishing {
+	headers := amqp.Table{
+		cloudEventsAMQPPrefix + "specversion": e.SpecVersion,
+		cloudEventsAMQPPrefix + "id":          e.ID,
+		cloudEventsAMQPPrefix + "source":      e.Source,
+		cloudEventsAMQPPrefix + "type":        e.Type,
+		schemaVersionHeader:                   schemaVersion,
+	}
+	optional := map[string]string{
+		"subject":    e.Subject,
+		"time":       e.Time,
+		"dataschema": e.DataSchema,
+	}
+	for name, value := range e.Extensions {
+		optional[name] = value
+	}
+	for name, value := range optional {
+		if value != "" {
+			headers[cloudEventsAMQPPrefix+name] = value
+		}
+	}
+	msg := amqp.Publishing{
+		Headers:     headers,
+		ContentType: e.DataContentType,
+		MessageId:   id,
+		Timestamp:   time.Now().UTC(),
+		Type:        e.action(),
+		AppId:       appID,
+		Body:        e.Data,
+	}
+	if t, err := time.Parse(time.RFC3339, e.Time); err == nil {
+		msg.Timestamp = t.UTC()
+	}
+	return msg
+}
+
+// handleCloudEvent queues a CloudEvent whose data is the request for the
+// action named by its type.
+func (c *Config) handleCloudEvent(w http.ResponseWriter, r *http.Request) {
+	if !isCloudEvent(r) {
+		c.ErrorJSON(w, errors.New("A CloudEvent in structured or binary mode is needed"), http.StatusUnsupportedMediaType)
+		return
+	}
+	event, err := readCloudEvent(w, r)
+	if err != nil {
+		c.ErrorJSON(w, err)
+		return
+	}
+	switch event.action() {
+	case Authorization, Logging, Send:
+	default:
+		c.ErrorJSON(w, errors.New("Unknown action type"))
+		return
+	}
+	enc, err := codecByContentType(event.DataContentType)
+	if err != nil {
+		c.ErrorJSON(w, err, http.StatusUnsupportedMediaType)
+		return
+	}
+	// the data is trimmed to the action like any queued request
+	var request requestType
+	if err := enc.unmarshal(event.Data, &request); err != nil {
+		c.ErrorJSON(w, errors.New("Invalid event data"))
+		return
+	}
+	request.Action = event.action()
+	if request.Action == Send {
+		if err := c.validateSend(request.Send); err != nil {
+			c.ErrorJSON(w, err)
+			return
+		}
+	}
+	if event.Data, err = enc.marshal(c.redactRequest(request)); err != nil {
+		c.ErrorJSON(w, err)
+		return
+	}
+	c.enqueue(w, r, event.action(), func(id string) (amqp.Publishing, error) {
+		return event.publishing(id), nil
+	})
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCloudEventSendIsValidated(t *testing.T) {
+	jobs, err := newJobStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Config{
+		redactor:   newTestRedactor(t, `{}`),
+		outbox:     openTestOutbox(t, t.TempDir()),
+		jobs:       jobs,
+		queue:      queneName,
+		recipients: &recipientLimits{maxRecipients: 2, maxSendAt: time.Hour},
+	}
+	tests := []struct {
+		name string
+		send string
+		want int
+	}{
+		{"valid", `{"to":"b@example.com","subject":"s"}`, http.StatusAccepted},
+		{"no recipients", `{"subject":"s"}`, http.StatusBadRequest},
+		{"invalid recipient", `{"to":"not an address"}`, http.StatusBadRequest},
+		{"too many recipients", `{"to":["a@example.com","b@example.com"],"cc":"c@example.com"}`, http.StatusBadRequest},
+		{"send_at too far ahead", `{"to":"b@example.com","send_at":"2999-01-01T00:00:00Z"}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		body := `{"specversion":"1.0","id":"1","source":"test","type":"broker.send","datacontenttype":"application/json",` +
+			`"data":{"send":` + tt.send + `}}`
+		r := httptest.NewRequest(http.MethodPost, "/events", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/cloudevents+json")
+		w := httptest.NewRecorder()
+		c.handleCloudEvent(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%s: got %d, want %d: %s", tt.name, w.Code, tt.want, w.Body.String())
+		}
+	}
+	if pending, _ := c.outbox.depth(); pending != 1 {
+		t.Errorf("%d events queued, want 1", pending)
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const DEADLETTER_SCAN_LIMIT = 1000
+
+var errDeadLetterNotFound = errors.New("Message not found")
+
+type deadLetter struct {
+	ID            string          `json:"id"`
+	Queue         string          `json:"queue"`
+	RoutingKey    string          `json:"routing_key"`
+	Reason        string          `json:"reason,omitempty"`
+	Retries       int             `json:"retries"`
+	MessageID     string          `json:"message_id,omitempty"`
+	CorrelationID string          `json:"correlation_id,omitempty"`
+	ContentType   string          `json:"content_type,omitempty"`
+	Timestamp     *time.Time      `json:"timestamp,omitempty"`
+	Headers       amqp.Table      `json:"headers,omitempty"`
+	Payload       *string         `json:"payload,omitempty"`
+	JSON          json.RawMessage `json:"json,omitempty"`
+	PayloadError  string          `json:"payload_error,omitempty"`
+}
+
+// deadLetterID identifies a message by its message id, or by a hash of
+// its body for publishers that do not set one.
+func deadLetterID(msg amqp.Delivery) string {
+	if msg.MessageId != "" {
+		return msg.MessageId
+	}
+	sum := sha256.Sum256(msg.Body)
+	return "sha256-" + hex.EncodeToString(sum[:8])
+}
+
+func newDeadLetter(queue string, msg amqp.Delivery, withPayload bool) deadLetter {
+	dl := deadLetter{
+		ID:            deadLetterID(msg),
+		Queue:         queue,
+		RoutingKey:    originalRoutingKey(msg),
+		Retries:       headerInt(msg.Headers, retryCountHeader),
+		MessageID:     msg.MessageId,
+		CorrelationID: msg.CorrelationId,
+		ContentType:   msg.ContentType,
+		Headers:       msg.Headers,
+	}
+	if !msg.Timestamp.IsZero() {
+		dl.Timestamp = &msg.Timestamp
+	}
+	if reason, ok := msg.Headers[lastErrorHeader].(string); ok {
+		dl.Reason = reason
+	} else if deaths, ok := msg.Headers["x-death"].([]interface{}); ok && len(deaths) > 0 {
+		// set by rabbit for messages that expired or were rejected
+		if death, ok := deaths[0].(amqp.Table); ok {
+			dl.Reason, _ = death["reason"].(string)
+		}
+	}
+	if withPayload {
+		payload := string(msg.Body)
+		dl.Payload = &payload
+		if json.Valid(msg.Body) {
+			dl.JSON = msg.Body
+		}
+	}
+	return dl
+}
+
+func originalRoutingKey(msg amqp.Delivery) string {
+	if key, ok := msg.Headers[originalRoutingKeyHeader].(string); ok && key != "" {
+		return key
+	}
+	return queneName
+}
+
+// deadLetterQueues returns the queues the admin API may read from, the
+// parking lot plus any listed in DEADLETTER_QUEUES.
+func deadLetterQueues() map[string]bool {
+	queues := map[string]bool{parkingQueueName: true}
+	for _, q := range strings.Split(os.Getenv("DEADLETTER_QUEUES"), ",") {
+		if q = strings.TrimSpace(q); q != "" {
+			queues[q] = true
+		}
+	}
+	return queues
+}
+
+// browseQueue fetches the messages of queue without acknowledging them
+// and calls visit for each one until it returns true. Messages that
+// visit did not ack are requeued in their original order when the
+// channel is closed.
+func (c *Config) browseQueue(queue string, visit func(msg amqp.Delivery) (bool, error)) error {
+	if !deadLetterQueues()[queue] {
+		return errors.New("Queue is not a dead letter queue")
+	}
+	if _, err := c.channel(); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+
+	for i := 0; i < DEADLETTER_SCAN_LIMIT; i++ {
+		msg, ok, err := ch.Get(queue, false)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return nil
+		}
+		stop, err := visit(msg)
+		if err != nil || stop {
+			return err
+		}
+		// messages that arrived after we started are not interesting
+		if msg.MessageCount == 0 {
+			return nil
+		}
+	}
+	return nil
+}
+
+// findDeadLetter runs action on the message with the given id.
+func (c *Config) findDeadLetter(queue, id string, action func(msg amqp.Delivery) error) error {
+	found := false
+	err := c.browseQueue(queue, func(msg amqp.Delivery) (bool, error) {
+		if deadLetterID(msg) != id {
+			return false, nil
+		}
+		found = true
+		return true, action(msg)
+	})
+	if err == nil && !found {
+		return errDeadLetterNotFound
+	}
+	return err
+}
+
+func deadLetterQueue(r *http.Request) string {
+	if queue := r.URL.Query().Get("queue"); queue != "" {
+		return queue
+	}
+	return parkingQueueName
+}
+
+func (c *Config) deadLetterError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errDeadLetterNotFound) {
+		c.ErrorJSON(w, err, http.StatusNotFound)
+		return
+	}
+	c.ErrorJSON(w, err)
+}
+
+func (c *Config) listDeadLetters(w http.ResponseWriter, r *http.Request) {
+	limit := 50
+	if value := r.URL.Query().Get("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit < 1 {
+			c.ErrorJSON(w, errors.New("Invalid limit"))
+			return
+		}
+	}
+	queue := deadLetterQueue(r)
+	messages := []deadLetter{}
+	err := c.browseQueue(queue, func(msg amqp.Delivery) (bool, error) {
+		messages = append(messages, newDeadLetter(queue, msg, false))
+		return len(messages) >= limit, nil
+	})
+	if err != nil {
+		c.deadLetterError(w, err)
+		return
+	}
+	response := jsonResponse{
+		Error:   false,
+		Message: "Dead letters in " + queue,
+		Data:    messages,
+	}
+	c.writeJSON(w, http.StatusOK, response)
+}
+
+func (c *Config) getDeadLetter(w http.ResponseWriter, r *http.Request) {
+	queue := deadLetterQueue(r)
+	var message deadLetter
+	err := c.findDeadLetter(queue, chi.URLParam(r, "id"), func(msg amqp.Delivery) error {
+		message = c.showDeadLetter(queue, msg)
+		return nil
+	})
+	if err != nil {
+		c.deadLetterError(w, err)
+		return
+	}
+	response := jsonResponse{
+		Error:   false,
+		Message: "Dead letter",
+		Data:    message,
+	}
+	c.writeJSON(w, http.StatusOK, response)
+}
+
+// showDeadLetter returns msg with its payload decrypted and redacted.
+// Replays publish the message as it is, still encrypted.
+func (c *Config) showDeadLetter(queue string, msg amqp.Delivery) deadLetter {
+	plain, err := c.keys.open(msg)
+	if err != nil {
+		dl := newDeadLetter(queue, msg, false)
+		dl.PayloadError = err.Error()
+		return dl
+	}
+	dl := newDeadLetter(queue, plain, true)
+	c.redactDeadLetter(&dl, plain)
+	return dl
+}
+
+// replayDeadLetter publishes the message back to its original routing
+// key with a fresh retry count and removes it from the queue.
+func (c *Config) replayDeadLetter(w http.ResponseWriter, r *http.Request) {
+	queue := deadLetterQueue(r)
+	var routingKey string
+	err := c.findDeadLetter(queue, chi.URLParam(r, "id"), func(msg amqp.Delivery) error {
+		out := publishingFromDelivery(msg)
+		delete(out.Headers, retryCountHeader)
+		delete(out.Headers, lastErrorHeader)
+		delete(out.Headers, parkedAtHeader)
+		out.Headers["x-replayed-at"] = time.Now().UTC().Format(time.RFC3339)
+		routingKey = originalRoutingKey(msg)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := c.publish(ctx, "", routingKey, out); err != nil {
+			return err
+		}
+		return msg.Ack(false)
+	})
+	if err != nil {
+		c.deadLetterError(w, err)
+		return
+	}
+	response := jsonResponse{
+		Error:   false,
+		Message: "Replayed to " + routingKey,
+	}
+	c.writeJSON(w, http.StatusAccepted, response)
+}
+
+func (c *Config) discardDeadLetter(w http.ResponseWriter, r *http.Request) {
+	err := c.findDeadLetter(deadLetterQueue(r), chi.URLParam(r, "id"), func(msg amqp.Delivery) error {
+		return msg.Ack(false)
+	})
+	if err != nil {
+		c.deadLetterError(w, err)
+		return
+	}
+	response := jsonResponse{
+		Error:   false,
+		Message: "Discarded",
+	}
+	c.writeJSON(w, http.StatusOK, response)
+}
+
+// adminOnly requires the bearer token from ADMIN_TOKEN. Without a token
+// configured the admin endpoints are disabled.
+func (c *Config) adminOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := os.Getenv("ADMIN_TOKEN")
+		if token == "" {
+			c.ErrorJSON(w, errors.New("Admin API is disabled"), http.StatusForbidden)
+			return
+		}
+		if !hasBearerToken(r, token) {
+			c.ErrorJSON(w, errors.New("Unauthorized"), http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	authService        = "authentication"
+	loggingService     = "logging"
+	loggingGRPCService = "logging-grpc"
+	mailService        = "mail"
+)
+
+const (
+	DISCOVERY_REFRESH    = "30s"
+	DISCOVERY_EJECT_TIME = "30s"
+	DISCOVERY_MAX_FAILS  = 3
+)
+
+// discoveryBackoff is how long a service waits before it resolves again
+// after a failed lookup. It doubles with every failure, up to the
+// refresh interval.
+const discoveryBackoff = time.Second
+
+const (
+	roundRobin       = "round_robin"
+	leastOutstanding = "least_outstanding"
+)
+
+var errNoInstances = errors.New("no instances available")
+
+// resolver returns the current set of host:port addresses of a service.
+type resolver interface {
+	resolve(ctx context.Context) ([]string, error)
+}
+
+// staticResolver always returns the same addresses.
+type staticResolver struct {
+	addrs []string
+}
+
+func (r *staticResolver) resolve(ctx context.Context) ([]string, error) {
+	return r.addrs, nil
+}
+
+// srvResolver looks the addresses up from a DNS SRV record such as
+// _auth._tcp.example.com.
+type srvResolver struct {
+	name string
+}
+
+func (r *srvResolver) resolve(ctx context.Context) ([]string, error) {
+	_, records, err := net.DefaultResolver.LookupSRV(ctx, "", "", r.name)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]string, 0, len(records))
+	for _, record := range records {
+		target := strings.TrimSuffix(record.Target, ".")
+		addrs = append(addrs, net.JoinHostPort(target, strconv.Itoa(int(record.Port))))
+	}
+	return addrs, nil
+}
+
+// fileResolver reads one address per line from a local file. Blank
+// lines and lines starting with # are ignored.
+type fileResolver struct {
+	path        string
+	defaultPort string
+}
+
+func (r *fileResolver) resolve(ctx context.Context) ([]string, error) {
+	f, err := os.Open(r.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var addrs []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		addrs = append(addrs, withDefaultPort(line, r.defaultPort))
+	}
+	return addrs, scanner.Err()
+}
+
+func withDefaultPort(addr, port string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+	return net.JoinHostPort(addr, port)
+}
+
+type instance struct {
+	addr         string
+	outstanding  int
+	failures     int
+	ejectedUntil time.Time
+}
+
+// endpoint is a picked instance of a service. done must be called once
+// the call made against addr has finished.
+type endpoint struct {
+	addr string
+	done func(err error)
+}
+
+// service load balances calls over the instances returned by its
+// resolver and ejects instances that keep failing. The instances are
+// resolved again in the background once they are older than refresh;
+// until then, and while lookups fail, the last ones found are used.
+type service struct {
+	name      string
+	resolver  resolver
+	policy    string
+	refresh   time.Duration
+	maxFails  int
+	ejectTime time.Duration
+
+	mu        sync.Mutex
+	instances []*instance
+	resolved  time.Time
+	next      int
+	updating  chan struct{} // closed when the running lookup is done
+	failed    int           // lookups failed in a row
+	retryAt   time.Time     // no lookup before, after a failed one
+	lastErr   error
+}
+
+func (s *service) pick(ctx context.Context) (*endpoint, error) {
+	s.mu.Lock()
+	if time.Since(s.resolved) > s.refresh || len(s.instances) == 0 {
+		done := s.startUpdate()
+		if len(s.instances) == 0 && done != nil {
+			// there is nothing to fall back on, so wait for the lookup
+			s.mu.Unlock()
+			select {
+			case <-done:
+			case <-ctx.Done():
+				return nil, fmt.Errorf("%s: %w", s.name, ctx.Err())
+			}
+			s.mu.Lock()
+		}
+	}
+	defer s.mu.Unlock()
+	if len(s.instances) == 0 {
+		err := s.lastErr
+		if err == nil {
+			err = errNoInstances
+		}
+		return nil, fmt.Errorf("%s: %w", s.name, err)
+	}
+
+	now := time.Now()
+	healthy := make([]*instance, 0, len(s.instances))
+	for _, inst := range s.instances {
+		if now.After(inst.ejectedUntil) {
+			healthy = append(healthy, inst)
+		}
+	}
+	// if everything is ejected, keep trying all of them rather than
+	// failing every request
+	if len(healthy) == 0 {
+		healthy = s.instances
+	}
+
+	s.next++
+	inst := healthy[s.next%len(healthy)]
+	if s.policy == leastOutstanding {
+		for i := range healthy {
+			candidate := healthy[(s.next+i)%len(healthy)]
+			if candidate.outstanding < inst.outstanding {
+				inst = candidate
+			}
+		}
+	}
+	inst.outstanding++
+
+	var once sync.Once
+	return &endpoint{
+		addr: inst.addr,
+		done: func(err error) {
+			once.Do(func() { s.release(inst, err) })
+		},
+	}, nil
+}
+
+func (s *service) release(inst *instance, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	inst.outstanding--
+	if err == nil {
+		inst.failures = 0
+		return
+	}
+	inst.failures++
+	if inst.failures >= s.maxFails {
+		inst.failures = 0
+		inst.ejectedUntil = time.Now().Add(s.ejectTime)
+		fmt.Printf("ejecting %s instance %s for %s\n", s.name, inst.addr, s.ejectTime)
+	}
+}
+
+// startUpdate starts a lookup unless one is running or the last one
+// failed too recently. It returns a channel closed when the running
+// lookup is done, or nil if there is none. Must be called with s.mu held.
+func (s *service) startUpdate() chan struct{} {
+	if s.updating == nil && time.Now().After(s.retryAt) {
+		s.updating = make(chan struct{})
+		go s.update(s.updating)
+	}
+	return s.updating
+}
+
+// update resolves the instances without holding s.mu, then replaces the
+// instance list, keeping the state of instances that are still present.
+// A failed lookup keeps the old list.
+func (s *service) update(done chan struct{}) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	addrs, err := s.resolver.resolve(ctx)
+	cancel()
+	if err == nil && len(addrs) == 0 {
+		err = errNoInstances
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer close(done)
+	s.updating = nil
+	if err != nil {
+		s.failed++
+		backoff := discoveryBackoff << (s.failed - 1)
+		if backoff > s.refresh || backoff <= 0 {
+			backoff = s.refresh
+		}
+		s.retryAt = time.Now().Add(backoff)
+		s.lastErr = err
+		fmt.Printf("resolving %s failed, keeping %d instances and retrying in %s: %v\n", s.name, len(s.instances), backoff, err)
+		return
+	}
+	s.failed, s.retryAt, s.lastErr = 0, time.Time{}, nil
+	s.resolved = time.Now()
+
+	known := make(map[string]*instance, len(s.instances))
+	for _, inst := range s.instances {
+		known[inst.addr] = inst
+	}
+	instances := make([]*instance, 0, len(addrs))
+	for _, addr := range addrs {
+		if inst, ok := known[addr]; ok {
+			instances = append(instances, inst)
+		} else {
+			instances = append(instances, &instance{addr: addr})
+		}
+	}
+	s.instances = instances
+}
+
+// newService configures a service from the environment variables
+// starting with prefix:
+//
+//	<prefix>            comma separated hosts, with or without port
+//	<prefix>_DISCOVERY  static (default), dns or file
+//	<prefix>_SRV        SRV record name for dns discovery
+//	<prefix>_FILE       address file for file discovery
+//	<prefix>_LB         round_robin (default) or least_outstanding
+func newService(name, prefix, defaultHosts, defaultPort string) (*service, error) {
+	s := &service{name: name, maxFails: DISCOVERY_MAX_FAILS}
+
+	switch mode := getEnv(prefix+"_DISCOVERY", "static"); mode {
+	case "static":
+		var addrs []string
+		for _, host := range strings.Split(getEnv(prefix, defaultHosts), ",") {
+			if host = strings.TrimSpace(host); host != "" {
+				addrs = append(addrs, withDefaultPort(host, defaultPort))
+			}
+		}
+		s.resolver = &staticResolver{addrs: addrs}
+	case "dns":
+		srv := os.Getenv(prefix + "_SRV")
+		if srv == "" {
+			return nil, fmt.Errorf("%s_SRV is required for dns discovery", prefix)
+		}
+		s.resolver = &srvResolver{name: srv}
+	case "file":
+		path := os.Getenv(prefix + "_FILE")
+		if path == "" {
+			return nil, fmt.Errorf("%s_FILE is required for file discovery", prefix)
+		}
+		s.resolver = &fileResolver{path: path, defaultPort: defaultPort}
+	default:
+		return nil, fmt.Errorf("invalid %s_DISCOVERY %q", prefix, mode)
+	}
+
+	switch s.policy = getEnv(prefix+"_LB", roundRobin); s.policy {
+	case roundRobin, leastOutstanding:
+	default:
+		return nil, fmt.Errorf("invalid %s_LB %q", prefix, s.policy)
+	}
+
+	var err error
+	if s.refresh, err = getEnvDuration("DISCOVERY_REFRESH", DISCOVERY_REFRESH); err != nil {
+		return nil, err
+	}
+	if s.ejectTime, err = getEnvDuration("DISCOVERY_EJECT_TIME", DISCOVERY_EJECT_TIME); err != nil {
+		return nil, err
+	}
+	if s.maxFails, err = getEnvInt("DISCOVERY_MAX_FAILS", DISCOVERY_MAX_FAILS); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// newServices sets up discovery for every downstream service.
+func newServices() (map[string]*service, error) {
+	logHosts := getEnv("LOGGING_SERVICE", LOGGING_SERVICE)
+	specs := []struct {
+		name, prefix, hosts, port string
+	}{
+		{authService, "AUTHENTICATION_SERVICE", AUTHENTICATION_SERVICE, "85"},
+		{loggingService, "LOGGING_SERVICE", LOGGING_SERVICE, "4321"},
+		{loggingGRPCService, "LOGGING_GRPC_SERVICE", logHosts, "43210"},
+		{mailService, "MAIL_SERVICE", MAIL_SERVICE, "54321"},
+	}
+	services := make(map[string]*service, len(specs))
+	for _, spec := range specs {
+		s, err := newService(spec.name, spec.prefix, spec.hosts, spec.port)
+		if err != nil {
+			return nil, err
+		}
+		services[spec.name] = s
+	}
+	return services, nil
+}
+
+// pick returns an instance of the named service.
+func (c *Config) pick(ctx context.Context, name string) (*endpoint, error) {
+	s, ok := c.services[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown service %s", name)
+	}
+	return s.pick(ctx)
+}
+
+// upstreamError reports whether an HTTP call should count against the
+// health of the instance it was sent to.
+func upstreamError(resp *http.Response, err error) error {
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("upstream returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testResolver returns addrs or err, waiting for release if it is set.
+type testResolver struct {
+	mu      sync.Mutex
+	addrs   []string
+	err     error
+	calls   int
+	release chan struct{}
+}
+
+func (r *testResolver) resolve(ctx context.Context) ([]string, error) {
+	r.mu.Lock()
+	r.calls++
+	addrs, err, release := r.addrs, r.err, r.release
+	r.mu.Unlock()
+	if release != nil {
+		<-release
+	}
+	return addrs, err
+}
+
+func (r *testResolver) set(addrs []string, err error, release chan struct{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.addrs, r.err, r.release = addrs, err, release
+}
+
+func newTestService(r resolver, policy string) *service {
+	return &service{name: "test", resolver: r, policy: policy, refresh: time.Hour, maxFails: 2, ejectTime: time.Hour}
+}
+
+func TestServicePick(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy string
+		// hold keeps the endpoints picked so far outstanding
+		hold bool
+		fail string
+		want []string
+	}{
+		{"round robin", roundRobin, false, "", []string{"b", "c", "a", "b"}},
+		{"least outstanding", leastOutstanding, true, "", []string{"b", "c", "a", "b"}},
+		{"failing instance is ejected", roundRobin, false, "b", []string{"b", "c", "a", "b", "c", "a", "c", "a"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestService(&staticResolver{addrs: []string{"a", "b", "c"}}, tt.policy)
+			var got []string
+			for range tt.want {
+				e, err := s.pick(context.Background())
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, e.addr)
+				if tt.hold {
+					continue
+				}
+				var err2 error
+				if e.addr == tt.fail {
+					err2 = errors.New("down")
+				}
+				e.done(err2)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("picked %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServiceKeepsInstancesWhenLookupFails(t *testing.T) {
+	r := &testResolver{addrs: []string{"a"}}
+	s := newTestService(r, roundRobin)
+	if _, err := s.pick(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// the next lookup is due and fails
+	r.set(nil, errors.New("dns down"), nil)
+	s.mu.Lock()
+	s.resolved = time.Time{}
+	s.mu.Unlock()
+	for i := 0; i < 5; i++ {
+		e, err := s.pick(context.Background())
+		if err != nil || e.addr != "a" {
+			t.Fatalf("pick %d: %v, %v", i, e, err)
+		}
+		e.done(nil)
+	}
+	waitForLookup(t, s)
+	r.mu.Lock()
+	calls := r.calls
+	r.mu.Unlock()
+	if calls != 2 {
+		t.Errorf("resolved %d times, want 2 while backing off", calls)
+	}
+	s.mu.Lock()
+	retryAt := s.retryAt
+	s.mu.Unlock()
+	if time.Until(retryAt) <= 0 {
+		t.Error("no backoff after a failed lookup")
+	}
+}
+
+func TestServiceResolvesOutsideTheLock(t *testing.T) {
+	r := &testResolver{addrs: []string{"a"}}
+	s := newTestService(r, roundRobin)
+	if _, err := s.pick(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// a slow lookup doesn't hold up picks while there are instances
+	release := make(chan struct{})
+	r.set([]string{"b"}, nil, release)
+	s.mu.Lock()
+	s.resolved = time.Time{}
+	s.mu.Unlock()
+	picked := make(chan string)
+	go func() {
+		for i := 0; i < 3; i++ {
+			e, err := s.pick(context.Background())
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			picked <- e.addr
+		}
+	}()
+	for i := 0; i < 3; i++ {
+		select {
+		case addr := <-picked:
+			if addr != "a" {
+				t.Errorf("picked %s before the lookup finished", addr)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("pick waited for the lookup")
+		}
+	}
+	close(release)
+	waitForLookup(t, s)
+	if e, err := s.pick(context.Background()); err != nil || e.addr != "b" {
+		t.Errorf("after the lookup: %v, %v", e, err)
+	}
+}
+
+func TestServiceWithoutInstances(t *testing.T) {
+	tests := []struct {
+		name     string
+		resolver resolver
+	}{
+		{"no addresses", &staticResolver{}},
+		{"lookup fails", &testResolver{err: errors.New("dns down")}},
+	}
+	for _, tt := range tests {
+		s := newTestService(tt.resolver, roundRobin)
+		if _, err := s.pick(context.Background()); err == nil {
+			t.Errorf("%s: picked an instance", tt.name)
+		}
+	}
+
+	// a caller that gives up doesn't wait for the lookup
+	release := make(chan struct{})
+	defer close(release)
+	s := newTestService(&testResolver{addrs: []string{"a"}, release: release}, roundRobin)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := s.pick(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want the context error", err)
+	}
+}
+
+func TestFileResolver(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hosts")
+	content := "# auth instances\nauth-1\n\n  auth-2:9000  \n"
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	addrs, err := (&fileResolver{path: path, defaultPort: "85"}).resolve(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"auth-1:85", "auth-2:9000"}; !reflect.DeepEqual(addrs, want) {
+		t.Errorf("got %v, want %v", addrs, want)
+	}
+}
+
+func TestNewService(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		wantErr bool
+	}{
+		{"static", map[string]string{"TEST_SERVICE": "a, b:90"}, false},
+		{"dns without srv", map[string]string{"TEST_SERVICE_DISCOVERY": "dns"}, true},
+		{"file without path", map[string]string{"TEST_SERVICE_DISCOVERY": "file"}, true},
+		{"unknown discovery", map[string]string{"TEST_SERVICE_DISCOVERY": "zookeeper"}, true},
+		{"unknown policy", map[string]string{"TEST_SERVICE_LB": "random"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+			_, err := newService("test", "TEST_SERVICE", "localhost", "80")
+			if (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+	s, err := newService("test", "TEST_SERVICE", "a, b:90", "80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a:80", "b:90"}; !reflect.DeepEqual(s.resolver.(*staticResolver).addrs, want) {
+		t.Errorf("got %v, want %v", s.resolver.(*staticResolver).addrs, want)
+	}
+}
+
+// waitForLookup waits until no lookup of s is running.
+func waitForLookup(t *testing.T, s *service) {
+	t.Helper()
+	s.mu.Lock()
+	done := s.updating
+	s.mu.Unlock()
+	if done == nil {
+		return
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("lookup didn't finish")
+	}
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"broker/api/queue"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const MESSAGE_ENCODING = "json"
+
+const (
+	appID               = "broker"
+	schemaVersion       = "1"
+	schemaVersionHeader = "x-schema-version"
+	encodingHeader      = "X-Message-Encoding"
+)
+
+// codec encodes queued requests for one content type.
+type codec struct {
+	name        string
+	contentType string
+	marshal     func(v any) ([]byte, error)
+	unmarshal   func(data []byte, v any) error
+}
+
+var codecs = []codec{
+	{"json", "application/json", json.Marshal, json.Unmarshal},
+	{"protobuf", "application/x-protobuf", protobufMarshal, protobufUnmarshal},
+	{"msgpack", "application/msgpack", viaJSON(msgpack.Marshal), fromJSON(msgpackUnmarshal)},
+}
+
+// codecByName returns the codec selected by name, e.g. from the
+// X-Message-Encoding header.
+func codecByName(name string) (codec, error) {
+	for _, c := range codecs {
+		if c.name == name {
+			return c, nil
+		}
+	}
+	return codec{}, fmt.Errorf("unknown message encoding %q", name)
+}
+
+// requestCodec returns the codec asked for with X-Message-Encoding, or
+// the MESSAGE_ENCODING default.
+func requestCodec(r *http.Request) (codec, error) {
+	encoding := r.Header.Get(encodingHeader)
+	if encoding == "" {
+		encoding = getEnv("MESSAGE_ENCODING", MESSAGE_ENCODING)
+	}
+	return codecByName(encoding)
+}
+
+// codecByContentType returns the codec for a received message. Messages
+// published before the envelope existed are plain JSON labelled
+// text/plain.
+func codecByContentType(contentType string) (codec, error) {
+	contentType, _, _ = strings.Cut(contentType, ";")
+	switch strings.TrimSpace(contentType) {
+	case "", "text/plain":
+		return codecs[0], nil
+	}
+	for _, c := range codecs {
+		if c.contentType == contentType {
+			return c, nil
+		}
+	}
+	return codec{}, fmt.Errorf("unsupported content type %q", contentType)
+}
+
+// newEnvelope encodes request and fills in the message properties that
+// identify it.
+func newEnvelope(c codec, id string, request requestType) (amqp.Publishing, error) {
+	body, err := c.marshal(request)
+	if err != nil {
+		return amqp.Publishing{}, err
+	}
+	return amqp.Publishing{
+		Headers:     amqp.Table{schemaVersionHeader: schemaVersion},
+		ContentType: c.contentType,
+		MessageId:   id,
+		Timestamp:   time.Now().UTC(),
+		Type:        request.Action,
+		AppId:       appID,
+		Body:        body,
+	}, nil
+}
+
+// decodeRequest decodes a queued request according to its content type.
+func decodeRequest(msg amqp.Delivery) (requestType, error) {
+	var request requestType
+	c, err := codecByContentType(msg.ContentType)
+	if err != nil {
+		return request, err
+	}
+	if err := c.unmarshal(msg.Body, &request); err != nil {
+		return request, err
+	}
+	// CloudEvents carry the action in their type only
+	if eventType, ok := msg.Headers[cloudEventsAMQPPrefix+"type"].(string); ok && request.Action == "" {
+		request.Action = actionFromCloudEventType(eventType)
+	}
+	return request, nil
+}
+
+// viaJSON adapts an encoder of generic values to any JSON serialisable
+// value.
+func viaJSON(marshal func(v any) ([]byte, error)) func(v any) ([]byte, error) {
+	return func(v any) ([]byte, error) {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		var generic any
+		if err := json.Unmarshal(data, &generic); err != nil {
+			return nil, err
+		}
+		return marshal(generic)
+	}
+}
+
+func fromJSON(unmarshal func(data []byte) (any, error)) func(data []byte, v any) error {
+	return func(data []byte, v any) error {
+		generic, err := unmarshal(data)
+		if err != nil {
+			return err
+		}
+		b, err := json.Marshal(generic)
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(b, v)
+	}
+}
+
+// protobufMarshal encodes a request as an api.v1.QueuedRequest.
+func protobufMarshal(v any) ([]byte, error) {
+	var request requestType
+	switch v := v.(type) {
+	case requestType:
+		request = v
+	case *requestType:
+		request = *v
+	default:
+		return nil, fmt.Errorf("protobuf encoding needs a request, got %T", v)
+	}
+	msg, err := requestToProto(request)
+	if err != nil {
+		return nil, err
+	}
+	return proto.Marshal(msg)
+}
+
+func protobufUnmarshal(data []byte, v any) error {
+	request, ok := v.(*requestType)
+	if !ok {
+		return fmt.Errorf("protobuf encoding needs a request, got %T", v)
+	}
+	msg := &queue.QueuedRequest{}
+	if err := proto.Unmarshal(data, msg); err != nil {
+		return err
+	}
+	return requestFromProto(msg, request)
+}
+
+func requestToProto(request requestType) (*queue.QueuedRequest, error) {
+	logFields, err := toStruct(request.Log.Fields)
+	if err != nil {
+		return nil, err
+	}
+	sendData, err := toStruct(request.Send.Data)
+	if err != nil {
+		return nil, err
+	}
+	send := request.Send
+	msg := &queue.QueuedRequest{
+		Action: request.Action,
+		Auth:   &queue.QueuedAuth{Email: request.Auth.Email, Password: request.Auth.Password},
+		Log: &queue.QueuedLog{
+			Name:      request.Log.Name,
+			Message:   request.Log.Message,
+			Level:     request.Log.Level,
+			Timestamp: toTimestamp(request.Log.Timestamp),
+			Source:    request.Log.Source,
+			Fields:    logFields,
+		},
+		Send: &queue.QueuedSend{
+			From:        send.From,
+			FromName:    send.FromName,
+			To:          send.To,
+			Cc:          send.CC,
+			Bcc:         send.BCC,
+			ReplyTo:     send.ReplyTo,
+			Headers:     send.Headers,
+			SendAt:      toTimestamp(send.SendAt),
+			Subject:     send.Subject,
+			Body:        send.Body,
+			Attachments: send.Attachment,
+			PlainText:   send.PlainText,
+			Template:    send.Template,
+			Data:        sendData,
+		},
+	}
+	for _, file := range send.Files {
+		msg.Send.Files = append(msg.Send.Files, &queue.QueuedAttachment{
+			Filename:    file.Filename,
+			ContentType: file.ContentType,
+			Size:        file.Size,
+			Data:        file.Data,
+			Url:         file.URL,
+		})
+	}
+	return msg, nil
+}
+
+func requestFromProto(msg *queue.QueuedRequest, request *requestType) error {
+	auth, entry, send := msg.GetAuth(), msg.GetLog(), msg.GetSend()
+	*request = requestType{
+		Action: msg.GetAction(),
+		Auth:   authType{Email: auth.GetEmail(), Password: auth.GetPassword()},
+		Log: logType{
+			Name:      entry.GetName(),
+			Message:   entry.GetMessage(),
+			Level:     entry.GetLevel(),
+			Timestamp: fromTimestamp(entry.GetTimestamp()),
+			Source:    entry.GetSource(),
+		},
+		Send: sendType{
+			From:       send.GetFrom(),
+			FromName:   send.GetFromName(),
+			To:         send.GetTo(),
+			CC:         send.GetCc(),
+			BCC:        send.GetBcc(),
+			ReplyTo:    send.GetReplyTo(),
+			Headers:    send.GetHeaders(),
+			SendAt:     fromTimestamp(send.GetSendAt()),
+			Subject:    send.GetSubject(),
+			Body:       send.GetBody(),
+			Attachment: send.GetAttachments(),
+			PlainText:  send.GetPlainText(),
+			Template:   send.GetTemplate(),
+		},
+	}
+	if fields := entry.GetFields(); fields != nil {
+		request.Log.Fields = fields.AsMap()
+	}
+	if data := send.GetData(); data != nil {
+		request.Send.Data = data.AsMap()
+	}
+	for _, file := range send.GetFiles() {
+		request.Send.Files = append(request.Send.Files, attachmentType{
+			Filename:    file.GetFilename(),
+			ContentType: file.GetContentType(),
+			Size:        file.GetSize(),
+			Data:        file.GetData(),
+			URL:         file.GetUrl(),
+		})
+	}
+	return nil
+}
+
+// toStruct converts a JSON object to a google.protobuf.Struct, through
+// its JSON so any value encoding/json takes is accepted.
+func toStruct(m map[string]any) (*structpb.Struct, error) {
+	if m == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	s := &structpb.Struct{}
+	if err := s.UnmarshalJSON(data); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func toTimestamp(t *time.Time) *timestamppb.Timestamp {
+	if t == nil {
+		return nil
+	}
+	return timestamppb.New(*t)
+}
+
+func fromTimestamp(ts *timestamppb.Timestamp) *time.Time {
+	if ts == nil {
+		return nil
+	}
+	t := ts.AsTime()
+	return &t
+}
+
+// msgpackUnmarshal decodes MessagePack into the generic values of
+// encoding/json.
+func msgpackUnmarshal(data []byte) (any, error) {
+	var v any
+	err := msgpack.Unmarshal(data, &v)
+	return v, err
+}
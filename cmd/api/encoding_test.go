@@ -0,0 +1,152 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// boundaryValues holds values around the size limits of the MessagePack
+// formats for integers, strings, arrays and maps.
+func boundaryValues() map[string]any {
+	values := map[string]any{}
+	for _, n := range []float64{0, 1, 127, 128, 255, 256, 65535, 65536, math.MaxUint32, math.MaxUint32 + 1, 1 << 53} {
+		values["int_"+strconv.FormatFloat(n, 'f', -1, 64)] = n
+		values["neg_"+strconv.FormatFloat(n, 'f', -1, 64)] = -n
+	}
+	for _, n := range []float64{-32, -33, -128, -129, -32768, -32769, math.MinInt32, math.MinInt32 - 1} {
+		values["min_"+strconv.FormatFloat(n, 'f', -1, 64)] = n
+	}
+	values["float"] = 1.5
+	values["tiny"] = 1e-300
+	for _, n := range []int{0, 31, 32, 255, 256, 65535, 65536} {
+		values["string_"+strconv.Itoa(n)] = strings.Repeat("x", n)
+	}
+	values["unicode"] = "héllo wörld ✉"
+	for _, n := range []int{0, 15, 16, 65535, 65536} {
+		list := make([]any, n)
+		for i := range list {
+			list[i] = float64(i % 3)
+		}
+		values["array_"+strconv.Itoa(n)] = list
+	}
+	for _, n := range []int{0, 15, 16, 65536} {
+		m := make(map[string]any, n)
+		for i := 0; i < n; i++ {
+			m["k"+strconv.Itoa(i)] = true
+		}
+		values["map_"+strconv.Itoa(n)] = m
+	}
+	values["nested"] = map[string]any{"list": []any{nil, false, "x", map[string]any{"deep": 1.0}}}
+	return values
+}
+
+func testRequests() map[string]requestType {
+	timestamp := time.Date(2024, 5, 1, 12, 30, 0, 123000000, time.UTC)
+	return map[string]requestType{
+		"authentication": {Action: Authorization, Auth: authType{Email: "a@example.com", Password: "secret"}},
+		"logging": {Action: Logging, Log: logType{
+			Name: "event", Message: "something happened", Level: "warn", Source: "api",
+			Timestamp: &timestamp, Fields: boundaryValues(),
+		}},
+		"send": {Action: Send, Send: sendType{
+			From: "from@example.com", FromName: "From", To: addressList{"a@example.com", "b@example.com"},
+			CC: addressList{"c@example.com"}, BCC: addressList{"d@example.com"}, ReplyTo: "r@example.com",
+			Headers: map[string]string{"X-Campaign": "spring"}, SendAt: &timestamp, Subject: "Hi", Body: "<p>Hi</p>",
+			Files:     []attachmentType{{Filename: "a.txt", ContentType: "text/plain", Size: 3, Data: "YWJj"}},
+			PlainText: "Hi", Template: "welcome", Data: map[string]any{"name": "Ann", "count": 3.0},
+		}},
+		"empty": {},
+	}
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	for _, c := range codecs {
+		for name, request := range testRequests() {
+			t.Run(c.name+"/"+name, func(t *testing.T) {
+				msg, err := newEnvelope(c, "id", request)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err := decodeRequest(amqp.Delivery{ContentType: msg.ContentType, Headers: msg.Headers, Body: msg.Body})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(normalize(t, got), normalize(t, request)) {
+					t.Errorf("round trip changed the request:\ngot  %+v\nwant %+v", got, request)
+				}
+			})
+		}
+	}
+}
+
+// normalize maps a request to its JSON form, where an absent and an empty
+// list or map are the same.
+func normalize(t *testing.T, request requestType) any {
+	t.Helper()
+	var out any
+	data, err := codecs[0].marshal(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := codecs[0].unmarshal(data, &out); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestMsgpackBoundaries(t *testing.T) {
+	msgpack, err := codecByName("msgpack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, value := range boundaryValues() {
+		data, err := msgpack.marshal(map[string]any{"v": value})
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		var got map[string]any
+		if err := msgpack.unmarshal(data, &got); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !reflect.DeepEqual(got["v"], value) {
+			t.Errorf("%s: got %v", name, got["v"])
+		}
+	}
+}
+
+func TestCodecByContentType(t *testing.T) {
+	tests := []struct {
+		contentType string
+		want        string
+		wantErr     bool
+	}{
+		{"", "json", false},
+		{"text/plain", "json", false},
+		{"application/json; charset=utf-8", "json", false},
+		{"application/x-protobuf", "protobuf", false},
+		{"application/msgpack", "msgpack", false},
+		{"application/xml", "", true},
+	}
+	for _, tt := range tests {
+		c, err := codecByContentType(tt.contentType)
+		if (err != nil) != tt.wantErr || c.name != tt.want {
+			t.Errorf("%q: got %q, %v", tt.contentType, c.name, err)
+		}
+	}
+}
+
+func TestProtobufNeedsARequest(t *testing.T) {
+	if _, err := protobufMarshal(map[string]any{"action": "send"}); err == nil {
+		t.Error("expected an error for a map")
+	}
+	var v map[string]any
+	if err := protobufUnmarshal(nil, &v); err == nil {
+		t.Error("expected an error for a map")
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	MESSAGE_ENCRYPTION = false
+	MESSAGE_KEYS_DIR   = "keys"
+)
+
+const (
+	encryptionHeader          = "x-encryption"
+	encryptionKeyIDHeader     = "x-encryption-key-id"
+	encryptedKeyHeader        = "x-encrypted-key"
+	originalContentTypeHeader = "x-original-content-type"
+	encryptionAlgorithm       = "aes-256-gcm"
+	encryptedContentType      = "application/octet-stream"
+)
+
+var keyIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// keyring holds the key encryption keys from MESSAGE_KEYS_DIR, one
+// <id>.key file each with 32 bytes in base64 or hex. Queued bodies are
+// encrypted with a fresh data key, which is encrypted with the active
+// key and sent along in a header. Old keys stay in the directory until
+// no message needs them any more.
+type keyring struct {
+	mu      sync.Mutex
+	dir     string
+	keys    map[string][]byte
+	active  string
+	encrypt bool
+}
+
+// loadKeyring returns nil when encryption is off and there are no keys
+// to decrypt with either.
+func loadKeyring() (*keyring, error) {
+	encrypt, err := getEnvBool("MESSAGE_ENCRYPTION", MESSAGE_ENCRYPTION)
+	if err != nil {
+		return nil, err
+	}
+	k := &keyring{dir: getEnv("MESSAGE_KEYS_DIR", MESSAGE_KEYS_DIR), encrypt: encrypt}
+	if err := k.reload(); err != nil {
+		if !encrypt && errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if !encrypt {
+		return k, nil
+	}
+	if len(k.keys) == 0 {
+		return nil, fmt.Errorf("no keys in %s", k.dir)
+	}
+	// without MESSAGE_KEY_ID the key sorting last is used, so a new key
+	// named after the date takes over on restart
+	k.active = getEnv("MESSAGE_KEY_ID", "")
+	if k.active == "" {
+		ids := make([]string, 0, len(k.keys))
+		for id := range k.keys {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		k.active = ids[len(ids)-1]
+	}
+	if _, ok := k.keys[k.active]; !ok {
+		return nil, fmt.Errorf("MESSAGE_KEY_ID %s not found in %s", k.active, k.dir)
+	}
+	return k, nil
+}
+
+// reload reads the keys from the directory again.
+func (k *keyring) reload() error {
+	paths, err := filepath.Glob(filepath.Join(k.dir, "*.key"))
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(k.dir); err != nil {
+		return err
+	}
+	keys := make(map[string][]byte, len(paths))
+	for _, path := range paths {
+		id := strings.TrimSuffix(filepath.Base(path), ".key")
+		if !keyIDPattern.MatchString(id) {
+			return fmt.Errorf("invalid key id %q", id)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		key, err := parseKey(strings.TrimSpace(string(data)))
+		if err != nil {
+			return fmt.Errorf("key %s: %w", id, err)
+		}
+		keys[id] = key
+	}
+	k.mu.Lock()
+	k.keys = keys
+	k.mu.Unlock()
+	return nil
+}
+
+func parseKey(s string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(key) != 32 {
+		key, err = hex.DecodeString(s)
+	}
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("expected 32 bytes in base64 or hex")
+	}
+	return key, nil
+}
+
+// key returns the key for id, reading the directory again for keys
+// added since.
+func (k *keyring) key(id string) ([]byte, error) {
+	k.mu.Lock()
+	key, ok := k.keys[id]
+	k.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+	if err := k.reload(); err != nil {
+		return nil, err
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if key, ok = k.keys[id]; !ok {
+		return nil, fmt.Errorf("unknown encryption key %s", id)
+	}
+	return key, nil
+}
+
+// seal encrypts the body of msg, if encryption is on.
+func (k *keyring) seal(msg *amqp.Publishing) error {
+	if k == nil || !k.encrypt {
+		return nil
+	}
+	kek, err := k.key(k.active)
+	if err != nil {
+		return err
+	}
+	dek := make([]byte, 32)
+	if _, err := rand.Read(dek); err != nil {
+		return err
+	}
+	// the key id is authenticated with both, so a header pointing at
+	// another key fails to decrypt
+	body, err := gcmSeal(dek, msg.Body, []byte(k.active))
+	if err != nil {
+		return err
+	}
+	wrapped, err := gcmSeal(kek, dek, []byte(k.active))
+	if err != nil {
+		return err
+	}
+	if msg.Headers == nil {
+		msg.Headers = amqp.Table{}
+	}
+	msg.Headers[encryptionHeader] = encryptionAlgorithm
+	msg.Headers[encryptionKeyIDHeader] = k.active
+	msg.Headers[encryptedKeyHeader] = base64.StdEncoding.EncodeToString(wrapped)
+	msg.Headers[originalContentTypeHeader] = msg.ContentType
+	msg.ContentType = encryptedContentType
+	msg.Body = body
+	return nil
+}
+
+// open returns msg with its body decrypted. Messages that aren't
+// encrypted are returned as they are.
+func (k *keyring) open(msg amqp.Delivery) (amqp.Delivery, error) {
+	algorithm, _ := msg.Headers[encryptionHeader].(string)
+	if algorithm == "" {
+		return msg, nil
+	}
+	if algorithm != encryptionAlgorithm {
+		return msg, fmt.Errorf("unsupported encryption %s", algorithm)
+	}
+	if k == nil {
+		return msg, errors.New("message is encrypted but no keys are configured")
+	}
+	id, _ := msg.Headers[encryptionKeyIDHeader].(string)
+	kek, err := k.key(id)
+	if err != nil {
+		return msg, err
+	}
+	encoded, _ := msg.Headers[encryptedKeyHeader].(string)
+	wrapped, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return msg, errors.New("invalid encrypted key")
+	}
+	dek, err := gcmOpen(kek, wrapped, []byte(id))
+	if err != nil {
+		return msg, fmt.Errorf("decrypting data key: %w", err)
+	}
+	body, err := gcmOpen(dek, msg.Body, []byte(id))
+	if err != nil {
+		return msg, fmt.Errorf("decrypting message: %w", err)
+	}
+	msg.Body = body
+	msg.ContentType, _ = msg.Headers[originalContentTypeHeader].(string)
+	return msg, nil
+}
+
+// gcmSeal encrypts plaintext with key and returns the nonce followed by
+// the ciphertext.
+func gcmSeal(key, plaintext, additional []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additional), nil
+}
+
+func gcmOpen(key, sealed, additional []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, additional)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func writeKey(t *testing.T, dir, id string) {
+	t.Helper()
+	key := make([]byte, 32)
+	rand.Read(key)
+	if err := os.WriteFile(filepath.Join(dir, id+".key"), []byte(base64.StdEncoding.EncodeToString(key)+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newTestKeyring(t *testing.T, dir string) *keyring {
+	t.Helper()
+	t.Setenv("MESSAGE_ENCRYPTION", "true")
+	t.Setenv("MESSAGE_KEYS_DIR", dir)
+	k, err := loadKeyring()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func sealed(t *testing.T, k *keyring, body string) amqp.Delivery {
+	t.Helper()
+	msg := amqp.Publishing{ContentType: "application/json", Body: []byte(body)}
+	if err := k.seal(&msg); err != nil {
+		t.Fatal(err)
+	}
+	return amqp.Delivery{ContentType: msg.ContentType, Headers: msg.Headers, Body: msg.Body}
+}
+
+func TestKeyringRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	writeKey(t, dir, "2026-01")
+	k := newTestKeyring(t, dir)
+
+	msg := sealed(t, k, `{"action":"auth"}`)
+	if bytes.Contains(msg.Body, []byte("auth")) || msg.ContentType != encryptedContentType {
+		t.Fatalf("body not encrypted: %q %s", msg.Body, msg.ContentType)
+	}
+	plain, err := k.open(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plain.Body) != `{"action":"auth"}` || plain.ContentType != "application/json" {
+		t.Errorf("got %q %s", plain.Body, plain.ContentType)
+	}
+	unencrypted := amqp.Delivery{Body: []byte("plain")}
+	if got, err := k.open(unencrypted); err != nil || string(got.Body) != "plain" {
+		t.Errorf("unencrypted message: %q, %v", got.Body, err)
+	}
+}
+
+func TestKeyringRotation(t *testing.T) {
+	dir := t.TempDir()
+	writeKey(t, dir, "2026-01")
+	old := newTestKeyring(t, dir)
+	before := sealed(t, old, "before")
+
+	writeKey(t, dir, "2026-02")
+	rotated := newTestKeyring(t, dir)
+	if rotated.active != "2026-02" {
+		t.Fatalf("active key %s, want the new one", rotated.active)
+	}
+	after := sealed(t, rotated, "after")
+	if id := after.Headers[encryptionKeyIDHeader]; id != "2026-02" {
+		t.Errorf("sealed with %v", id)
+	}
+
+	tests := []struct {
+		name string
+		k    *keyring
+		msg  amqp.Delivery
+		want string
+	}{
+		{"old message, new keyring", rotated, before, "before"},
+		{"new message, keyring loaded before the new key", old, after, "after"},
+	}
+	for _, tt := range tests {
+		plain, err := tt.k.open(tt.msg)
+		if err != nil || string(plain.Body) != tt.want {
+			t.Errorf("%s: got %q, %v", tt.name, plain.Body, err)
+		}
+	}
+}
+
+func TestKeyringRejectsTampering(t *testing.T) {
+	dir := t.TempDir()
+	writeKey(t, dir, "a")
+	writeKey(t, dir, "b")
+	k := newTestKeyring(t, dir)
+
+	tests := []struct {
+		name   string
+		tamper func(msg *amqp.Delivery)
+	}{
+		{"key id of another key", func(msg *amqp.Delivery) { msg.Headers[encryptionKeyIDHeader] = "a" }},
+		{"unknown key id", func(msg *amqp.Delivery) { msg.Headers[encryptionKeyIDHeader] = "c" }},
+		{"path as key id", func(msg *amqp.Delivery) { msg.Headers[encryptionKeyIDHeader] = "../b" }},
+		{"algorithm", func(msg *amqp.Delivery) { msg.Headers[encryptionHeader] = "rot13" }},
+		{"wrapped key", func(msg *amqp.Delivery) { msg.Headers[encryptedKeyHeader] = "!" }},
+		{"body", func(msg *amqp.Delivery) { msg.Body[len(msg.Body)-1] ^= 1 }},
+	}
+	for _, tt := range tests {
+		msg := sealed(t, k, "secret")
+		tt.tamper(&msg)
+		if _, err := k.open(msg); err == nil {
+			t.Errorf("%s: opened a tampered message", tt.name)
+		}
+	}
+}
+
+func TestShowDeadLetterDecrypts(t *testing.T) {
+	dir := t.TempDir()
+	writeKey(t, dir, "a")
+	t.Setenv("REDACTION_FILE", filepath.Join(dir, "missing.json"))
+	redactor, err := loadRedactor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Config{keys: newTestKeyring(t, dir), redactor: redactor}
+
+	msg := sealed(t, c.keys, `{"action":"auth","auth":{"email":"a@example.com","password":"hunter2"}}`)
+	dl := c.showDeadLetter(parkingQueueName, msg)
+	if dl.Payload == nil || dl.PayloadError != "" {
+		t.Fatalf("no payload: %+v", dl)
+	}
+	if !strings.Contains(*dl.Payload, `"action":"auth"`) || strings.Contains(*dl.Payload, "hunter2") || strings.Contains(*dl.Payload, "a@example.com") {
+		t.Errorf("payload not decrypted and redacted: %s", *dl.Payload)
+	}
+	if dl.ContentType != "application/json" {
+		t.Errorf("content type %s", dl.ContentType)
+	}
+
+	msg.Headers[encryptionKeyIDHeader] = "b"
+	dl = c.showDeadLetter(parkingQueueName, msg)
+	if dl.Payload != nil || dl.PayloadError == "" {
+		t.Errorf("undecryptable message shown: %+v", dl)
+	}
+}
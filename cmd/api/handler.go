@@ -8,6 +8,7 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"mime"
 	"net/http"
 	"time"
 
@@ -49,37 +50,81 @@ type authType struct {
 }
 
 type logType struct {
-	Name    string `json:"name"`
-	Message string `json:"message"`
+	Name      string         `json:"name"`
+	Message   string         `json:"message"`
+	Level     string         `json:"level,omitempty"`
+	Timestamp *time.Time     `json:"timestamp,omitempty"`
+	Source    string         `json:"source,omitempty"`
+	Fields    map[string]any `json:"fields,omitempty"`
 }
 
 type sendType struct {
-	From       string   `josn:"from,omitempty"`
-	FromName   string   `josn:"from_name,omitempty"`
-	To         string   `josn:"to"`
-	Subject    string   `josn:"subject"`
-	Body       string   `json:"body"`
-	Attachment []string `josn:"attachments,omitempty"`
+	From       string            `json:"from,omitempty"`
+	FromName   string            `json:"from_name,omitempty"`
+	To         addressList       `json:"to"`
+	CC         addressList       `json:"cc,omitempty"`
+	BCC        addressList       `json:"bcc,omitempty"`
+	ReplyTo    string            `json:"reply_to,omitempty"`
+	Headers    map[string]string `json:"headers,omitempty"`
+	SendAt     *time.Time        `json:"send_at,omitempty"`
+	Subject    string            `json:"subject"`
+	Body       string            `json:"body"`
+	Attachment []string          `json:"attachments,omitempty"`
+	Files      []attachmentType  `json:"files,omitempty"`
+	PlainText  string            `json:"plain_text,omitempty"`
+	Template   string            `json:"template,omitempty"`
+	Data       map[string]any    `json:"data,omitempty"`
 }
 
 func (c *Config) Newhandler() *Handler {
 	r := chi.NewRouter()
 	r.Use(cors.Handler(cors.Options{
-		AllowedOrigins:   []string{"https://*", "http//*"},
-		AllowedMethods:   []string{"GET", "POST", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
-		ExposedHeaders:   []string{"Link"},
+		AllowedOrigins: []string{"https://*", "http//*"},
+		AllowedMethods: []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
+		AllowedHeaders: []string{
+			"Accept", "Authorization", "Content-Type", "X-CSRF-Token",
+			"Idempotency-Key", "X-Message-Encoding", "X-Message-Priority", "X-Message-TTL",
+			"ce-specversion", "ce-id", "ce-source", "ce-type", "ce-subject", "ce-time",
+		},
+		ExposedHeaders:   []string{"Link", "Location", "Idempotent-Replayed"},
 		AllowCredentials: false,
 		MaxAge:           300,
 	}))
 
 	r.Use(middleware.Heartbeat("/ping"))
+	r.Use(c.redactRequestURI)
 	r.Use(middleware.Logger)
 	r.Post("/", c.broker)
 	r.Get("/hello", c.getHello)
-	r.Post("/handle", c.handle)
+	r.With(c.idempotent).Post("/handle", c.handle)
 	r.Post("/grpclog", c.handleLoggingViaGRPC)
-	r.Post("/handleviaqueue", c.handleEvent)
+	r.With(c.idempotent).Post("/handleviaqueue", c.handleEvent)
+	r.With(c.idempotent).Post("/events", c.handleCloudEvent)
+	r.With(c.idempotent).Post("/batch", c.handleBatch)
+	r.Post("/mail", c.handleMail)
+	r.Get("/attachments/{id}", c.getAttachment)
+	r.Get("/mail/templates", c.listTemplates)
+	r.Post("/mail/templates/{name}/preview", c.previewTemplate)
+	r.Post("/mail/templates/{name}/validate", c.validateTemplate)
+	r.Post("/mail/events", c.handleMailEvents)
+	r.Get("/workflows", c.listWorkflows)
+	r.With(c.requireToken).Post("/workflows/{name}/runs", c.startWorkflow)
+	r.With(c.requireToken).Get("/workflows/runs/{id}", c.getWorkflowRun)
+	r.Get("/jobs", c.listJobs)
+	r.Get("/jobs/{id}", c.getJob)
+	r.Method(http.MethodGet, "/metrics", c.metrics)
+	c.mountProxyRoutes(r)
+	r.Route("/admin", func(r chi.Router) {
+		r.Use(c.adminOnly)
+		r.Get("/deadletters", c.listDeadLetters)
+		r.Get("/deadletters/{id}", c.getDeadLetter)
+		r.Post("/deadletters/{id}/replay", c.replayDeadLetter)
+		r.Delete("/deadletters/{id}", c.discardDeadLetter)
+		r.Get("/suppressions", c.listSuppressions)
+		r.Post("/suppressions", c.addSuppressions)
+		r.Get("/suppressions/{address}", c.getSuppression)
+		r.Delete("/suppressions/{address}", c.removeSuppression)
+	})
 	return &Handler{
 		router: r,
 	}
@@ -89,15 +134,15 @@ func (c *Config) getHello(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 	body := "Hello World!"
-	err := c.ch.PublishWithContext(ctx,
-		"",        // exchange
-		queneName, // routing key
-		false,     // mandatory
-		false,     // immediate
-		amqp.Publishing{
+	// the worker only understands requests, so the greeting goes to a
+	// queue of its own that keeps the last one for a minute
+	err := c.declareHelloQueue()
+	if err == nil {
+		err = c.publish(ctx, "", helloQueueName, amqp.Publishing{
 			ContentType: "text/plain",
 			Body:        []byte(body),
 		})
+	}
 	if err != nil {
 		fmt.Println(err.Error())
 		response := jsonResponse{
@@ -116,6 +161,24 @@ func (c *Config) getHello(w http.ResponseWriter, r *http.Request) {
 	c.writeJSON(w, http.StatusAccepted, response)
 }
 
+const helloQueueName = "broker.hello"
+
+func (c *Config) declareHelloQueue() error {
+	ch, err := c.channel()
+	if err != nil {
+		return err
+	}
+	_, err = ch.QueueDeclare(
+		helloQueueName, // name
+		false,          // durable
+		false,          // delete when unused
+		false,          // exclusive
+		false,          // no-wait
+		amqp.Table{"x-max-length": int32(1), "x-message-ttl": int32(60000)}, // arguments
+	)
+	return err
+}
+
 func (c *Config) broker(w http.ResponseWriter, r *http.Request) {
 	response := jsonResponse{
 		Error:   false,
@@ -124,144 +187,324 @@ func (c *Config) broker(w http.ResponseWriter, r *http.Request) {
 	c.writeJSON(w, http.StatusAccepted, response)
 }
 
+var errUnknownAction = errors.New("Unknown action type")
+
 func (c *Config) handle(w http.ResponseWriter, r *http.Request) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "multipart/form-data" {
+		c.handleMail(w, r)
+		return
+	}
 	var request requestType
 	c.readJSON(w, r, &request)
+	payload, err := c.runAction(r.Context(), request)
+	if errors.Is(err, errUnknownAction) {
+		c.ErrorJSON(w, err)
+		return
+	}
+	if err != nil {
+		c.ErrorJSON(w, err, http.StatusAccepted)
+		return
+	}
+	c.writeJSON(w, http.StatusAccepted, payload)
+}
+
+// runAction executes request against the downstream service of its
+// action. It is shared by /handle and the queue worker.
+func (c *Config) runAction(ctx context.Context, request requestType) (jsonResponse, error) {
 	switch request.Action {
 	case Authorization:
-		c.handleAuthorization(request.Auth, w)
+		return c.handleAuthorization(ctx, request.Auth)
 	case Logging:
-		c.handleLogging(request.Log, w)
+		return c.handleLogging(ctx, request.Log)
 	case Send:
-		c.handleSendEmail(request.Send, w)
+		return c.handleSendEmail(ctx, request.Send)
 	default:
-		c.ErrorJSON(w, errors.New("Unknown action type"))
+		return jsonResponse{}, errUnknownAction
 	}
 }
 
-func (c *Config) handleAuthorization(request authType, w http.ResponseWriter) {
+func (c *Config) handleAuthorization(ctx context.Context, request authType) (jsonResponse, error) {
 	postBody, _ := json.Marshal(request)
 	responseBody := bytes.NewBuffer(postBody)
-	auth_url := getEnv("AUTHENTICATION_SERVICE", AUTHENTICATION_SERVICE)
-	resp, err := http.Post("http://"+auth_url+":85/auth", "application/json", responseBody)
+	instance, err := c.pick(ctx, authService)
 	if err != nil {
-		c.ErrorJSON(w, errors.New("Authrization error, request failed"), http.StatusAccepted)
-		return
+		return jsonResponse{}, errors.New("Authrization error, request failed")
+	}
+	resp, err := postJSON(ctx, "http://"+instance.addr+"/auth", responseBody)
+	instance.done(upstreamError(resp, err))
+	if err != nil {
+		return jsonResponse{}, errors.New("Authrization error, request failed")
 	}
 	defer resp.Body.Close()
 
 	var payloadfromService jsonResponse
 	err = json.NewDecoder(resp.Body).Decode(&payloadfromService)
 	if err != nil {
-		c.ErrorJSON(w, errors.New("Authentication failed"), http.StatusAccepted)
-		return
+		return jsonResponse{}, errors.New("Authentication failed")
 	}
 
 	if payloadfromService.Error {
-		c.ErrorJSON(w, errors.New("Authentication failed"), http.StatusAccepted)
-		return
+		return jsonResponse{}, errors.New("Authentication failed")
 	}
 	var payload jsonResponse
 	payload.Error = false
 	payload.Message = "Authenticated"
 	payload.Data = payloadfromService.Data
 
-	c.writeJSON(w, http.StatusAccepted, payload)
+	return payload, nil
+}
 
+func (c *Config) handleLogging(ctx context.Context, request logType) (jsonResponse, error) {
+	if !logRedacted(ctx) {
+		request = redactAs(c.redactor, stageLog, request)
+	}
+	keep, err := c.prepareLog(&request)
+	if err != nil {
+		return jsonResponse{}, err
+	}
+	if !keep {
+		return jsonResponse{Error: false, Message: "Log dropped"}, nil
+	}
+	// try the transports of LOG_TRANSPORTS in order until one takes it
+	err = errors.New("Logging error")
+	for _, transport := range c.logTransports {
+		var payload jsonResponse
+		switch transport {
+		case logViaHTTP:
+			payload, err = c.logViaHTTP(ctx, request)
+		case logViaGRPC:
+			payload, err = c.logViaGRPC(ctx, request)
+		case logViaQueue:
+			if c.outbox == nil {
+				// the worker can't queue what it consumes
+				continue
+			}
+			payload, err = c.logViaQueue(request)
+		}
+		if err == nil {
+			return payload, nil
+		}
+		log.Printf("logging via %s failed: %v\n", transport, err)
+	}
+	return jsonResponse{}, err
 }
 
-func (c *Config) handleLogging(request logType, w http.ResponseWriter) {
+func (c *Config) logViaHTTP(ctx context.Context, request logType) (jsonResponse, error) {
+	if c.logBuffer != nil {
+		if err := c.logBuffer.add(request); err != nil {
+			return jsonResponse{}, errors.New("Logging error")
+		}
+		return jsonResponse{Error: false, Message: "Log buffered"}, nil
+	}
 	postBody, _ := json.Marshal(request)
 	responseBody := bytes.NewBuffer(postBody)
-	log_url := getEnv("LOGGING_SERVICE", LOGGING_SERVICE)
-	resp, err := http.Post("http://"+log_url+":4321/log", "application/json", responseBody)
+	instance, err := c.pick(ctx, loggingService)
 	if err != nil {
-		c.ErrorJSON(w, errors.New("Logging error"), http.StatusAccepted)
-		return
+		return jsonResponse{}, errors.New("Logging error")
+	}
+	resp, err := postJSON(ctx, "http://"+instance.addr+"/log", responseBody)
+	instance.done(upstreamError(resp, err))
+	if err != nil {
+		return jsonResponse{}, errors.New("Logging error")
 	}
 	defer resp.Body.Close()
 
 	var payloadfromService jsonResponse
 	err = json.NewDecoder(resp.Body).Decode(&payloadfromService)
 	if err != nil {
-		c.ErrorJSON(w, errors.New("Log failed"), http.StatusAccepted)
-		return
+		return jsonResponse{}, errors.New("Log failed")
 	}
 
 	if payloadfromService.Error {
-		c.ErrorJSON(w, errors.New("Log failed"), http.StatusAccepted)
-		return
+		return jsonResponse{}, errors.New("Log failed")
 	}
 	var payload jsonResponse
 	payload.Error = false
 	payload.Message = "Logged"
 	payload.Data = payloadfromService.Data
 
-	c.writeJSON(w, http.StatusAccepted, payload)
+	return payload, nil
+}
 
+func (c *Config) handleSendEmail(ctx context.Context, request sendType) (jsonResponse, error) {
+	if err := c.validateSend(request); err != nil {
+		return jsonResponse{}, err
+	}
+	if err := c.applySuppressions(&request); err != nil {
+		return jsonResponse{}, err
+	}
+	if request.scheduled() {
+		return c.scheduleEmail(request)
+	}
+	if err := c.applyTemplate(&request); err != nil {
+		return jsonResponse{}, err
+	}
+	return c.sendEmail(ctx, request)
 }
 
-func (c *Config) handleSendEmail(request sendType, w http.ResponseWriter) {
+// errMailUnavailable is returned when the mail service can't be reached.
+var errMailUnavailable = errors.New("Sending Email error")
+
+func (c *Config) sendViaService(ctx context.Context, request sendType) (jsonResponse, error) {
 	postBody, _ := json.Marshal(request)
 	responseBody := bytes.NewBuffer(postBody)
-	mail_url := getEnv("MAIL_SERVICE", MAIL_SERVICE)
-	resp, err := http.Post("http://"+mail_url+":54321/send", "application/json", responseBody)
+	instance, err := c.pick(ctx, mailService)
 	if err != nil {
-		c.ErrorJSON(w, errors.New("Sending Email error"), http.StatusAccepted)
-		return
+		return jsonResponse{}, errMailUnavailable
+	}
+	resp, err := postJSON(ctx, "http://"+instance.addr+"/send", responseBody)
+	instance.done(upstreamError(resp, err))
+	if err != nil {
+		return jsonResponse{}, errMailUnavailable
 	}
 	defer resp.Body.Close()
 
 	var payloadfromService jsonResponse
 	err = json.NewDecoder(resp.Body).Decode(&payloadfromService)
 	if err != nil {
-		c.ErrorJSON(w, errors.New("Sending Email failed"), http.StatusAccepted)
-		return
+		return jsonResponse{}, errors.New("Sending Email failed")
 	}
 
 	if payloadfromService.Error {
-		c.ErrorJSON(w, errors.New("Sending Email failed"), http.StatusAccepted)
-		return
+		return jsonResponse{}, errors.New("Sending Email failed")
 	}
 	var payload jsonResponse
 	payload.Error = false
 	payload.Message = "Email Sent"
 	payload.Data = payloadfromService.Data
 
-	c.writeJSON(w, http.StatusAccepted, payload)
-
+	return payload, nil
 }
 
 func (c *Config) handleEvent(w http.ResponseWriter, r *http.Request) {
+	if isCloudEvent(r) {
+		c.handleCloudEvent(w, r)
+		return
+	}
 	var request requestType
 	c.readJSON(w, r, &request)
-	postBody, _ := json.Marshal(request)
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-	err := c.ch.PublishWithContext(ctx,
-		"",        // exchange
-		queneName, // routing key
-		false,     // mandatory
-		false,     // immediate
-		amqp.Publishing{
-			ContentType: "text/plain",
-			Body:        []byte(postBody),
-		})
+	enc, err := requestCodec(r)
+	if err != nil {
+		c.ErrorJSON(w, err)
+		return
+	}
+	if request.Action == Send {
+		if err := c.validateSend(request.Send); err != nil {
+			c.ErrorJSON(w, err)
+			return
+		}
+	}
+	c.enqueue(w, r, request.Action, func(id string) (amqp.Publishing, error) {
+		return newEnvelope(enc, id, c.redactRequest(request))
+	})
+}
+
+// enqueue creates a job for action and stores the message built for it
+// in the outbox, answering with the job.
+func (c *Config) enqueue(w http.ResponseWriter, r *http.Request, action string, build func(id string) (amqp.Publishing, error)) {
+	queued, err := c.newQueuedMessage(r, action, build)
+	if err != nil {
+		c.ErrorJSON(w, err)
+		return
+	}
+	// the outbox relay publishes the message once rabbit is reachable
+	err = c.outbox.append(queued.record)
 	if err != nil {
 		fmt.Println(err.Error())
+		c.jobs.delete(queued.job.ID)
 		response := jsonResponse{
 			Error:   true,
 			Message: "Send to Queue Error!!",
 		}
-		c.writeJSON(w, http.StatusBadRequest, response)
+		c.writeJSON(w, queueErrorStatus(err), response)
 		return
 	}
 	fmt.Println("sent to queue")
 	response := jsonResponse{
 		Error:   false,
 		Message: "Request Sent to Queue!!",
+		Data:    queued.job,
 	}
-	c.writeJSON(w, http.StatusAccepted, response)
+	headers := http.Header{}
+	headers.Set("Location", "/jobs/"+queued.job.ID)
+	c.writeJSON(w, http.StatusAccepted, response, headers)
+}
+
+// queuedMessage is a message ready for the outbox and the job tracking it.
+type queuedMessage struct {
+	job    job
+	record outboxRecord
+}
+
+// newQueuedMessage creates the job for action and builds its message.
+// The caller must delete the job if storing the message fails.
+func (c *Config) newQueuedMessage(r *http.Request, action string, build func(id string) (amqp.Publishing, error)) (queuedMessage, error) {
+	priority, expiration, err := c.deliveryOptions(r, action)
+	if err != nil {
+		return queuedMessage{}, err
+	}
+	j := c.jobs.create(action)
+	msg, err := build(j.ID)
+	if err != nil {
+		c.jobs.delete(j.ID)
+		return queuedMessage{}, err
+	}
+	markLogRedacted(&msg, action)
+	msg.Priority = priority
+	msg.Expiration = expiration
+	msg.CorrelationId = j.ID
+	msg.ReplyTo = replyQueueName
+	if err := c.keys.seal(&msg); err != nil {
+		c.jobs.delete(j.ID)
+		return queuedMessage{}, err
+	}
+	return queuedMessage{
+		job: j,
+		record: outboxRecord{
+			Exchange:   "",
+			RoutingKey: c.queue,
+			Msg:        msg,
+		},
+	}, nil
+}
+
+// queueRequest stores request in the outbox as a new job, for actions
+// that end up queued without an HTTP request of their own. Their logs
+// come from handleLogging and already had the log rules applied.
+func (c *Config) queueRequest(request requestType) (job, error) {
+	enc, err := codecByName(getEnv("MESSAGE_ENCODING", MESSAGE_ENCODING))
+	if err != nil {
+		return job{}, err
+	}
+	j := c.jobs.create(request.Action)
+	msg, err := newEnvelope(enc, j.ID, c.trimRequest(request))
+	if err != nil {
+		c.jobs.delete(j.ID)
+		return job{}, err
+	}
+	markLogRedacted(&msg, request.Action)
+	msg.Priority = uint8(c.delivery[request.Action].priority)
+	msg.Expiration = expiration(c.delivery[request.Action].ttl)
+	msg.CorrelationId = j.ID
+	msg.ReplyTo = replyQueueName
+	if err := c.keys.seal(&msg); err != nil {
+		c.jobs.delete(j.ID)
+		return job{}, err
+	}
+	err = c.outbox.append(outboxRecord{Exchange: "", RoutingKey: c.queue, Msg: msg})
+	if err != nil {
+		c.jobs.delete(j.ID)
+		return job{}, err
+	}
+	return j, nil
+}
+
+func queueErrorStatus(err error) int {
+	if errors.Is(err, errOutboxFull) {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusBadRequest
 }
 
 func (c *Config) handleLoggingViaGRPC(w http.ResponseWriter, r *http.Request) {
@@ -271,22 +514,45 @@ func (c *Config) handleLoggingViaGRPC(w http.ResponseWriter, r *http.Request) {
 		c.ErrorJSON(w, errors.New("Error Action Type. Logging Action is needed"), http.StatusAccepted)
 		return
 	}
-	log_url := getEnv("LOGGING_SERVICE", LOGGING_SERVICE)
-	conn, err := grpc.Dial(log_url+":43210", grpc.WithTransportCredentials(insecure.NewCredentials()))
+	request.Log = redactAs(c.redactor, stageLog, request.Log)
+	keep, err := c.prepareLog(&request.Log)
+	if err != nil {
+		c.ErrorJSON(w, err)
+		return
+	}
+	if !keep {
+		c.writeJSON(w, http.StatusAccepted, jsonResponse{Error: false, Message: "Log dropped"})
+		return
+	}
+	payload, err := c.logViaGRPC(r.Context(), request.Log)
+	if err != nil {
+		c.ErrorJSON(w, err, http.StatusAccepted)
+		return
+	}
+	c.writeJSON(w, http.StatusAccepted, payload)
+}
+
+func (c *Config) logViaGRPC(ctx context.Context, request logType) (jsonResponse, error) {
+	instance, err := c.pick(ctx, loggingGRPCService)
+	if err != nil {
+		return jsonResponse{}, errors.New("Log failed via GRPC")
+	}
+	conn, err := grpc.Dial(instance.addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
 	if err != nil {
-		log.Fatalf("did not connect: %v", err)
+		instance.done(err)
 		fmt.Println("connect to grcp log failed")
+		return jsonResponse{}, errors.New("Log failed via GRPC")
 	}
 	defer conn.Close()
 	fmt.Println("New client")
 	client := logging.NewLogClient(conn)
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
 	defer cancel()
-	resp, err := client.LogViaGRPC(ctx, &logging.LogRequest{Name: request.Log.Name, Data: request.Log.Message})
+	resp, err := client.LogViaGRPC(ctx, logRequestGRPC(request))
+	instance.done(err)
 
 	if err != nil {
-		c.ErrorJSON(w, errors.New("Log failed via GRPC"), http.StatusAccepted)
-		return
+		return jsonResponse{}, errors.New("Log failed via GRPC")
 	}
 
 	var payload jsonResponse
@@ -294,6 +560,19 @@ func (c *Config) handleLoggingViaGRPC(w http.ResponseWriter, r *http.Request) {
 	payload.Message = "Logged via GRPC"
 	payload.Data = resp.Message
 
-	c.writeJSON(w, http.StatusAccepted, payload)
+	return payload, nil
+}
 
+// logViaQueue queues the log for the worker, which sends it with the
+// other transports.
+func (c *Config) logViaQueue(request logType) (jsonResponse, error) {
+	j, err := c.queueRequest(requestType{Action: Logging, Log: request})
+	if err != nil {
+		return jsonResponse{}, err
+	}
+	var payload jsonResponse
+	payload.Error = false
+	payload.Message = "Log queued"
+	payload.Data = j
+	return payload, nil
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"io"
@@ -61,3 +62,13 @@ func (c *Config) ErrorJSON(w http.ResponseWriter, err error, statusCode ...int)
 	}
 	c.writeJSON(w, status, payLoad)
 }
+
+// postJSON posts body to url, giving up when ctx is done.
+func postJSON(ctx context.Context, url string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return http.DefaultClient.Do(req)
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const IDEMPOTENCY_TTL = "24h"
+
+const idempotencyHeader = "Idempotency-Key"
+
+type storedResponse struct {
+	hash    [sha256.Size]byte
+	done    bool
+	status  int
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+// idempotencyStore remembers the response given to each Idempotency-Key
+// for the configured window.
+type idempotencyStore struct {
+	mu        sync.Mutex
+	responses map[string]*storedResponse
+	ttl       time.Duration
+}
+
+func newIdempotencyStore() (*idempotencyStore, error) {
+	ttl, err := getEnvDuration("IDEMPOTENCY_TTL", IDEMPOTENCY_TTL)
+	if err != nil {
+		return nil, err
+	}
+	return &idempotencyStore{responses: make(map[string]*storedResponse), ttl: ttl}, nil
+}
+
+// begin reserves key for a request with the given body hash. If the key
+// was already used the stored entry is returned instead.
+func (s *idempotencyStore) begin(key string, hash [sha256.Size]byte) (storedResponse, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for k, resp := range s.responses {
+		if resp.done && now.After(resp.expires) {
+			delete(s.responses, k)
+		}
+	}
+	if resp, ok := s.responses[key]; ok {
+		return *resp, false
+	}
+	s.responses[key] = &storedResponse{hash: hash}
+	return storedResponse{}, true
+}
+
+func (s *idempotencyStore) finish(key string, rec *responseRecorder) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// failures may be temporary, a downstream or queue error is answered
+	// with error set rather than a server error, so neither is kept and
+	// the client can retry with the same key
+	var payload jsonResponse
+	if rec.status >= http.StatusInternalServerError || json.Unmarshal(rec.body.Bytes(), &payload) == nil && payload.Error {
+		delete(s.responses, key)
+		return
+	}
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	resp := s.responses[key]
+	resp.done = true
+	resp.status = rec.status
+	resp.header = rec.Header().Clone()
+	resp.body = rec.body.Bytes()
+	resp.expires = time.Now().Add(s.ttl)
+}
+
+func (s *idempotencyStore) abort(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.responses, key)
+}
+
+// responseRecorder passes the response through while keeping a copy.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *responseRecorder) WriteHeader(statusCode int) {
+	rec.status = statusCode
+	rec.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+// idempotent replays the stored response when a request is retried with
+// the same Idempotency-Key and body, and rejects reuse of a key with a
+// different body. Requests without the header are passed through.
+func (c *Config) idempotent(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyHeader)
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		key = r.URL.Path + " " + key
+
+		hash, cleanup, err := c.hashBody(w, r)
+		if err != nil {
+			c.ErrorJSON(w, err)
+			return
+		}
+		defer cleanup()
+
+		stored, ok := c.idempotency.begin(key, hash)
+		if !ok {
+			switch {
+			case stored.hash != hash:
+				c.ErrorJSON(w, errors.New("Idempotency-Key was already used with a different request"), http.StatusUnprocessableEntity)
+			case !stored.done:
+				c.ErrorJSON(w, errors.New("A request with this Idempotency-Key is still in progress"), http.StatusConflict)
+			default:
+				for k, v := range stored.header {
+					w.Header()[k] = v
+				}
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(stored.status)
+				w.Write(stored.body)
+			}
+			return
+		}
+
+		rec := &responseRecorder{ResponseWriter: w}
+		defer func() {
+			if p := recover(); p != nil {
+				c.idempotency.abort(key)
+				panic(p)
+			}
+			c.idempotency.finish(key, rec)
+		}()
+		next.ServeHTTP(rec, r)
+	})
+}
+
+// hashBody reads the body of r to hash it and puts it back for the
+// handler. JSON bodies are kept in memory, multipart uploads are spooled
+// to a temporary file as they may be as large as the attachment limit.
+func (c *Config) hashBody(w http.ResponseWriter, r *http.Request) ([sha256.Size]byte, func(), error) {
+	var hash [sha256.Size]byte
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "multipart/form-data" {
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1024*1024))
+		if err != nil {
+			return hash, nil, err
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		return sha256.Sum256(body), func() {}, nil
+	}
+
+	file, err := os.CreateTemp("", "broker-upload-*")
+	if err != nil {
+		return hash, nil, err
+	}
+	cleanup := func() {
+		file.Close()
+		os.Remove(file.Name())
+	}
+	h := sha256.New()
+	// the same limit readMailForm applies
+	limit := c.attachments.maxTotal + 1024*1024
+	_, err = io.Copy(io.MultiWriter(file, h), http.MaxBytesReader(w, r.Body, limit))
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		cleanup()
+		return hash, nil, err
+	}
+	copy(hash[:], h.Sum(nil))
+	r.Body = file
+	return hash, cleanup, nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newIdempotentHandler(t *testing.T, handler http.HandlerFunc) http.Handler {
+	t.Helper()
+	store, err := newIdempotencyStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Config{idempotency: store, attachments: &attachmentLimits{maxTotal: 4 * 1024 * 1024}}
+	return c.idempotent(handler)
+}
+
+func TestIdempotentStoresOnlySuccesses(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		body       string
+		wantReplay bool
+	}{
+		{"success", http.StatusAccepted, `{"error":false,"message":"Email Sent"}`, true},
+		{"rejected request", http.StatusBadRequest, `{"error":true,"message":"The email has no recipients"}`, false},
+		{"downstream failure", http.StatusAccepted, `{"error":true,"message":"Sending Email error"}`, false},
+		{"server error", http.StatusInternalServerError, `oops`, false},
+		{"not json", http.StatusOK, `plain`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			handler := newIdempotentHandler(t, func(w http.ResponseWriter, r *http.Request) {
+				calls++
+				w.WriteHeader(tt.status)
+				io.WriteString(w, tt.body)
+			})
+			for i := 0; i < 2; i++ {
+				r := httptest.NewRequest(http.MethodPost, "/handle", strings.NewReader(`{"action":"send"}`))
+				r.Header.Set(idempotencyHeader, "key")
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, r)
+				if w.Code != tt.status || w.Body.String() != tt.body {
+					t.Fatalf("attempt %d: got %d %q", i, w.Code, w.Body.String())
+				}
+			}
+			wantCalls := 2
+			if tt.wantReplay {
+				wantCalls = 1
+			}
+			if calls != wantCalls {
+				t.Errorf("handler called %d times, want %d", calls, wantCalls)
+			}
+		})
+	}
+}
+
+func TestIdempotentRejectsChangedBody(t *testing.T) {
+	handler := newIdempotentHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"error":false}`)
+	})
+	for i, body := range []string{`{"a":1}`, `{"a":2}`} {
+		r := httptest.NewRequest(http.MethodPost, "/handle", strings.NewReader(body))
+		r.Header.Set(idempotencyHeader, "key")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if i == 1 && w.Code != http.StatusUnprocessableEntity {
+			t.Errorf("reused key got %d, want %d", w.Code, http.StatusUnprocessableEntity)
+		}
+	}
+}
+
+func TestIdempotentMultipartUpload(t *testing.T) {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("to", "to@example.com")
+	part, _ := form.CreateFormFile("file", "big.txt")
+	part.Write(bytes.Repeat([]byte("a"), 2*1024*1024))
+	form.Close()
+
+	var received int
+	handler := newIdempotentHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		reader, err := r.MultipartReader()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			n, _ := io.Copy(io.Discard, part)
+			received += int(n)
+		}
+		io.WriteString(w, `{"error":false}`)
+	})
+	r := httptest.NewRequest(http.MethodPost, "/handle", bytes.NewReader(body.Bytes()))
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	r.Header.Set(idempotencyHeader, "upload")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body.String())
+	}
+	if want := 2*1024*1024 + len("to@example.com"); received != want {
+		t.Errorf("handler read %d bytes, want %d", received, want)
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const replyQueueName = "broker.replies"
+
+const JOB_RETENTION = "1h"
+
+const (
+	jobQueued     = "queued"
+	jobProcessing = "processing"
+	jobSucceeded  = "succeeded"
+	jobFailed     = "failed"
+)
+
+type job struct {
+	ID        string    `json:"id"`
+	Action    string    `json:"action"`
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	Result    any       `json:"result,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (j *job) finished() bool {
+	return j.Status == jobSucceeded || j.Status == jobFailed
+}
+
+// jobReply is the message a consumer sends to the reply queue to report
+// progress on a job. JobID falls back to the message correlation id.
+type jobReply struct {
+	JobID  string `json:"job_id"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	Data   any    `json:"data,omitempty"`
+}
+
+// jobStore keeps the state of queued requests in memory. Finished jobs
+// are dropped once they are older than the retention window.
+type jobStore struct {
+	mu        sync.Mutex
+	jobs      map[string]*job
+	retention time.Duration
+}
+
+func newJobStore() (*jobStore, error) {
+	retention, err := getEnvDuration("JOB_RETENTION", JOB_RETENTION)
+	if err != nil {
+		return nil, err
+	}
+	return &jobStore{jobs: make(map[string]*job), retention: retention}, nil
+}
+
+func (s *jobStore) create(action string) job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prune()
+	now := time.Now().UTC()
+	j := &job{
+		ID:        newID(),
+		Action:    action,
+		Status:    jobQueued,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	s.jobs[j.ID] = j
+	return *j
+}
+
+func (s *jobStore) get(id string) (job, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j, ok := s.jobs[id]
+	if !ok {
+		return job{}, false
+	}
+	return *j, true
+}
+
+func (s *jobStore) delete(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.jobs, id)
+}
+
+func (s *jobStore) list(status string) []job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	jobs := make([]job, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		if status == "" || j.Status == status {
+			jobs = append(jobs, *j)
+		}
+	}
+	sort.Slice(jobs, func(a, b int) bool {
+		return jobs[a].CreatedAt.After(jobs[b].CreatedAt)
+	})
+	return jobs
+}
+
+func (s *jobStore) update(reply jobReply) error {
+	switch reply.Status {
+	case jobProcessing, jobSucceeded, jobFailed:
+	default:
+		return fmt.Errorf("invalid job status %q", reply.Status)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j, ok := s.jobs[reply.JobID]
+	if !ok {
+		return fmt.Errorf("unknown job %s", reply.JobID)
+	}
+	// replies may arrive out of order, never move a finished job back
+	if j.finished() {
+		return nil
+	}
+	j.Status = reply.Status
+	j.Error = reply.Error
+	j.Result = reply.Data
+	j.UpdatedAt = time.Now().UTC()
+	return nil
+}
+
+// prune must be called with s.mu held.
+func (s *jobStore) prune() {
+	cutoff := time.Now().Add(-s.retention)
+	for id, j := range s.jobs {
+		if j.finished() && j.UpdatedAt.Before(cutoff) {
+			delete(s.jobs, id)
+		}
+	}
+}
+
+// consumeReplies updates job state from the messages consumers send to
+// the reply queue.
+func (c *Config) consumeReplies() error {
+	ch, err := c.conn.Channel()
+	if err != nil {
+		return err
+	}
+	_, err = ch.QueueDeclare(
+		replyQueueName, // name
+		false,          // durable
+		false,          // delete when unused
+		false,          // exclusive
+		false,          // no-wait
+		nil,            // arguments
+	)
+	if err != nil {
+		return err
+	}
+	msgs, err := ch.Consume(
+		replyQueueName, // queue
+		"",             // consumer
+		true,           // auto-ack
+		false,          // exclusive
+		false,          // no-local
+		false,          // no-wait
+		nil,            // args
+	)
+	if err != nil {
+		return err
+	}
+	go func() {
+		for msg := range msgs {
+			c.handleReply(msg)
+		}
+		log.Println("reply consumer stopped")
+	}()
+	return nil
+}
+
+func (c *Config) handleReply(msg amqp.Delivery) {
+	var reply jobReply
+	if err := json.Unmarshal(msg.Body, &reply); err != nil {
+		log.Println("invalid job reply:", err)
+		return
+	}
+	if reply.JobID == "" {
+		reply.JobID = msg.CorrelationId
+	}
+	if err := c.jobs.update(reply); err != nil {
+		log.Println("job reply:", err)
+	}
+}
+
+func (c *Config) getJob(w http.ResponseWriter, r *http.Request) {
+	j, ok := c.jobs.get(chi.URLParam(r, "id"))
+	if !ok {
+		c.ErrorJSON(w, errors.New("Job not found"), http.StatusNotFound)
+		return
+	}
+	response := jsonResponse{
+		Error:   false,
+		Message: "Job " + j.Status,
+		Data:    j,
+	}
+	c.writeJSON(w, http.StatusOK, response)
+}
+
+func (c *Config) listJobs(w http.ResponseWriter, r *http.Request) {
+	response := jsonResponse{
+		Error:   false,
+		Message: "Jobs",
+		Data:    c.jobs.list(r.URL.Query().Get("status")),
+	}
+	c.writeJSON(w, http.StatusOK, response)
+}
+
+// newID returns a random 128 bit identifier in hex.
+func newID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
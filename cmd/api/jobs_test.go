@@ -0,0 +1,72 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestJobStoreUpdate(t *testing.T) {
+	s, err := newJobStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	j := s.create(Send)
+	tests := []struct {
+		name       string
+		reply      jobReply
+		wantErr    bool
+		wantStatus string
+	}{
+		{"processing", jobReply{JobID: j.ID, Status: jobProcessing}, false, jobProcessing},
+		{"invalid status", jobReply{JobID: j.ID, Status: "lost"}, true, jobProcessing},
+		{"unknown job", jobReply{JobID: "missing", Status: jobFailed}, true, jobProcessing},
+		{"succeeded", jobReply{JobID: j.ID, Status: jobSucceeded, Data: "sent"}, false, jobSucceeded},
+		{"late reply doesn't move it back", jobReply{JobID: j.ID, Status: jobProcessing}, false, jobSucceeded},
+	}
+	for _, tt := range tests {
+		if err := s.update(tt.reply); (err != nil) != tt.wantErr {
+			t.Errorf("%s: err = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+		if got, _ := s.get(j.ID); got.Status != tt.wantStatus {
+			t.Errorf("%s: status %s, want %s", tt.name, got.Status, tt.wantStatus)
+		}
+	}
+	if got, _ := s.get(j.ID); got.Result != "sent" {
+		t.Errorf("result %v, want sent", got.Result)
+	}
+}
+
+func TestJobStorePrune(t *testing.T) {
+	t.Setenv("JOB_RETENTION", "1m")
+	s, err := newJobStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := s.create(Send)
+	running := s.create(Send)
+	recent := s.create(Send)
+	s.update(jobReply{JobID: old.ID, Status: jobFailed})
+	s.update(jobReply{JobID: recent.ID, Status: jobSucceeded})
+	s.mu.Lock()
+	s.jobs[old.ID].UpdatedAt = time.Now().Add(-2 * time.Minute)
+	s.jobs[running.ID].UpdatedAt = time.Now().Add(-2 * time.Minute)
+	s.mu.Unlock()
+
+	// creating a job prunes the finished ones past the retention
+	s.create(Logging)
+	for _, tt := range []struct {
+		id   string
+		want bool
+	}{
+		{old.ID, false},
+		{running.ID, true},
+		{recent.ID, true},
+	} {
+		if _, ok := s.get(tt.id); ok != tt.want {
+			t.Errorf("job %s kept %v, want %v", tt.id, ok, tt.want)
+		}
+	}
+	if got := s.list(jobQueued); len(got) != 2 {
+		t.Errorf("%d queued jobs, want 2", len(got))
+	}
+}
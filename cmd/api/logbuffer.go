@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	LOG_BUFFER          = false
+	LOG_BUFFER_SIZE     = 100
+	LOG_BUFFER_MAX      = 10000
+	LOG_BUFFER_INTERVAL = "1s"
+	LOG_BULK_PATH       = "/logs"
+	LOG_SPILL_DIR       = "log-spill"
+	LOG_CLAIM_TIMEOUT   = "1m"
+)
+
+// postTimeout bounds a single call to the bulk endpoint.
+const postTimeout = 10 * time.Second
+
+// logBuffer collects log actions in memory and forwards them to the
+// logging service in batches, when LOG_BUFFER_SIZE entries are waiting
+// or every LOG_BUFFER_INTERVAL. Batches the service doesn't take are
+// spilled to LOG_SPILL_DIR and sent first once it is back.
+type logBuffer struct {
+	c            *Config
+	mu           sync.Mutex
+	entries      []logType
+	size         int
+	max          int
+	interval     time.Duration
+	claimTimeout time.Duration
+	path         string
+	dir          string
+	wake         chan struct{}
+	flushMu      sync.Mutex
+	spilled      *counter
+}
+
+// newLogBuffer returns nil unless LOG_BUFFER is set.
+func newLogBuffer(c *Config) (*logBuffer, error) {
+	enabled, err := getEnvBool("LOG_BUFFER", LOG_BUFFER)
+	if err != nil || !enabled {
+		return nil, err
+	}
+	size, err := getEnvInt("LOG_BUFFER_SIZE", LOG_BUFFER_SIZE)
+	if err != nil {
+		return nil, err
+	}
+	max, err := getEnvInt("LOG_BUFFER_MAX", LOG_BUFFER_MAX)
+	if err != nil {
+		return nil, err
+	}
+	interval, err := getEnvDuration("LOG_BUFFER_INTERVAL", LOG_BUFFER_INTERVAL)
+	if err != nil {
+		return nil, err
+	}
+	claimTimeout, err := getEnvDuration("LOG_CLAIM_TIMEOUT", LOG_CLAIM_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+	if size < 1 || max < size || interval <= 0 {
+		return nil, errors.New("LOG_BUFFER_SIZE must be at least 1 and at most LOG_BUFFER_MAX, and LOG_BUFFER_INTERVAL positive")
+	}
+	// a claim is held for at most one post, see post
+	if claimTimeout <= postTimeout {
+		return nil, fmt.Errorf("LOG_CLAIM_TIMEOUT must be longer than %s", postTimeout)
+	}
+	b := &logBuffer{
+		c:            c,
+		size:         size,
+		max:          max,
+		interval:     interval,
+		claimTimeout: claimTimeout,
+		path:         getEnv("LOG_BULK_PATH", LOG_BULK_PATH),
+		dir:          getEnv("LOG_SPILL_DIR", LOG_SPILL_DIR),
+		wake:         make(chan struct{}, 1),
+		spilled:      c.metrics.counter("broker_log_spilled_total", "Log entries spilled to disk."),
+	}
+	if err := os.MkdirAll(b.dir, 0o700); err != nil {
+		return nil, err
+	}
+	if err := b.recoverClaimed(); err != nil {
+		return nil, err
+	}
+	c.metrics.gauge("broker_log_buffer_entries", "Log entries waiting in memory.", func() float64 {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		return float64(len(b.entries))
+	})
+	return b, nil
+}
+
+// add buffers entry. When LOG_BUFFER_MAX entries are already waiting
+// they are spilled to disk rather than dropped.
+func (b *logBuffer) add(entry logType) error {
+	b.mu.Lock()
+	var full []logType
+	if len(b.entries) >= b.max {
+		full, b.entries = b.entries, nil
+	}
+	b.entries = append(b.entries, entry)
+	ready := len(b.entries) >= b.size
+	b.mu.Unlock()
+
+	if ready {
+		select {
+		case b.wake <- struct{}{}:
+		default:
+		}
+	}
+	if full != nil {
+		return b.spill(full)
+	}
+	return nil
+}
+
+// run flushes the buffer until ctx is done, then flushes it one last
+// time.
+func (b *logBuffer) run(ctx context.Context) {
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			b.flush(context.Background())
+			return
+		case <-ticker.C:
+		case <-b.wake:
+		}
+		b.flush(ctx)
+	}
+}
+
+// flush sends the spilled batches, oldest first, and then the buffered
+// entries. If the logging service fails, what is left goes to disk.
+func (b *logBuffer) flush(ctx context.Context) {
+	b.flushMu.Lock()
+	defer b.flushMu.Unlock()
+
+	err := b.replay(ctx)
+	for {
+		b.mu.Lock()
+		n := len(b.entries)
+		if n > b.size {
+			n = b.size
+		}
+		batch := b.entries[:n:n]
+		b.entries = b.entries[n:]
+		b.mu.Unlock()
+		if len(batch) == 0 {
+			return
+		}
+		if err == nil {
+			err = b.post(ctx, batch)
+			if err == nil {
+				continue
+			}
+			log.Println("log buffer: logging service unavailable, spilling to disk:", err)
+		}
+		if err := b.spill(batch); err != nil {
+			log.Println("log buffer: failed to spill, dropping logs:", err)
+		}
+	}
+}
+
+// post sends batch to the bulk endpoint of the logging service.
+func (b *logBuffer) post(ctx context.Context, batch []logType) error {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	instance, err := b.c.pick(ctx, loggingService)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, postTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://"+instance.addr+b.path, bytes.NewReader(body))
+	if err != nil {
+		instance.done(nil)
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	instance.done(upstreamError(resp, err))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("logging service returned %s", resp.Status)
+	}
+	return nil
+}
+
+// spill writes batch to a new file in the spill directory.
+func (b *logBuffer) spill(batch []logType) error {
+	data, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%020d-%s.json", time.Now().UnixNano(), newID()[:8])
+	tmp := filepath.Join(b.dir, name+".tmp")
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(b.dir, name)); err != nil {
+		return err
+	}
+	b.spilled.add(len(batch))
+	return nil
+}
+
+// replay sends the spilled batches in the order they were written and
+// removes them. It stops at the first one that fails.
+func (b *logBuffer) replay(ctx context.Context) error {
+	if err := b.recoverClaimed(); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(b.dir)
+	if err != nil {
+		return err
+	}
+	var names []string
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), ".json") {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		// claim the file first, the server and the worker may share
+		// the directory. The claim is dated so that other processes
+		// leave it alone until it is stale.
+		path := filepath.Join(b.dir, name)
+		claimed := path + ".replay"
+		now := time.Now()
+		if err := os.Chtimes(path, now, now); err != nil {
+			continue
+		}
+		if err := os.Rename(path, claimed); err != nil {
+			continue
+		}
+		data, err := os.ReadFile(claimed)
+		if err != nil {
+			continue
+		}
+		var batch []logType
+		if err := json.Unmarshal(data, &batch); err != nil {
+			log.Printf("log buffer: dropping corrupt spill file %s: %v\n", name, err)
+			os.Remove(claimed)
+			continue
+		}
+		if err := b.post(ctx, batch); err != nil {
+			os.Rename(claimed, path)
+			return err
+		}
+		os.Remove(claimed)
+	}
+	return nil
+}
+
+// recoverClaimed gives back the spill files a process claimed but
+// didn't get to send before it stopped. Claims younger than
+// LOG_CLAIM_TIMEOUT may still be held by a live process and are kept.
+func (b *logBuffer) recoverClaimed() error {
+	claimed, err := filepath.Glob(filepath.Join(b.dir, "*.json.replay"))
+	if err != nil {
+		return err
+	}
+	for _, path := range claimed {
+		info, err := os.Stat(path)
+		if err != nil || time.Since(info.ModTime()) < b.claimTimeout {
+			continue
+		}
+		if err := os.Rename(path, strings.TrimSuffix(path, ".replay")); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
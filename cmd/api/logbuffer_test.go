@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestLogBuffer(t *testing.T, addr string) *logBuffer {
+	t.Helper()
+	t.Setenv("LOGGING_SERVICE", addr)
+	s, err := newService(loggingService, "LOGGING_SERVICE", "", "4321")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Config{services: map[string]*service{loggingService: s}}
+	return &logBuffer{
+		c:            c,
+		size:         10,
+		max:          100,
+		interval:     time.Hour,
+		claimTimeout: time.Minute,
+		path:         LOG_BULK_PATH,
+		dir:          t.TempDir(),
+		wake:         make(chan struct{}, 1),
+		spilled:      &counter{},
+	}
+}
+
+func TestRecoverClaimed(t *testing.T) {
+	tests := []struct {
+		name string
+		age  time.Duration
+		want string
+	}{
+		{"claim in progress", time.Second, "a.json.replay"},
+		{"stale claim", 2 * time.Minute, "a.json"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestLogBuffer(t, "127.0.0.1:1")
+			path := filepath.Join(b.dir, "a.json.replay")
+			if err := os.WriteFile(path, []byte("[]"), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			modified := time.Now().Add(-tt.age)
+			if err := os.Chtimes(path, modified, modified); err != nil {
+				t.Fatal(err)
+			}
+			if err := b.recoverClaimed(); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := os.Stat(filepath.Join(b.dir, tt.want)); err != nil {
+				t.Errorf("want %s: %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestLogBufferFlushesWhenStopped(t *testing.T) {
+	var mu sync.Mutex
+	var received []logType
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var batch []logType
+		json.NewDecoder(r.Body).Decode(&batch)
+		mu.Lock()
+		received = append(received, batch...)
+		mu.Unlock()
+	}))
+	defer server.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	tests := []struct {
+		name      string
+		addr      string
+		delivered int
+		spilled   int
+	}{
+		{"service up", strings.TrimPrefix(server.URL, "http://"), 3, 0},
+		{"service down", strings.TrimPrefix(down.URL, "http://"), 0, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mu.Lock()
+			received = nil
+			mu.Unlock()
+			b := newTestLogBuffer(t, tt.addr)
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				b.run(ctx)
+			}()
+			for i := 0; i < 3; i++ {
+				b.add(logType{Name: "event"})
+			}
+			cancel()
+			<-done
+
+			mu.Lock()
+			defer mu.Unlock()
+			if len(received) != tt.delivered {
+				t.Errorf("delivered %d entries, want %d", len(received), tt.delivered)
+			}
+			if got := int(b.spilled.value.Load()); got != tt.spilled {
+				t.Errorf("spilled %d entries, want %d", got, tt.spilled)
+			}
+		})
+	}
+}
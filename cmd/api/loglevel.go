@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+	"time"
+
+	"broker/api/logging"
+
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	LOG_MIN_LEVEL     = "debug"
+	LOG_DEFAULT_LEVEL = "info"
+	LOG_TRANSPORTS    = "http"
+)
+
+// transports a logging action can be delivered with
+const (
+	logViaHTTP  = "http"
+	logViaGRPC  = "grpc"
+	logViaQueue = "queue"
+)
+
+// logLevels are the accepted log levels, from the least to the most
+// severe.
+var logLevels = []string{"debug", "info", "warn", "error", "fatal"}
+
+func logLevelRank(level string) int {
+	for i, l := range logLevels {
+		if l == level {
+			return i
+		}
+	}
+	return -1
+}
+
+// logPolicy drops log actions below LOG_MIN_LEVEL and samples the rest
+// with the LOG_SAMPLE_<LEVEL> rate of their level.
+type logPolicy struct {
+	minLevel int
+	samples  map[string]float64
+	dropped  *counter
+}
+
+func loadLogPolicy(metrics *metricsRegistry) (*logPolicy, error) {
+	minLevel := logLevelRank(getEnv("LOG_MIN_LEVEL", LOG_MIN_LEVEL))
+	if minLevel < 0 {
+		return nil, fmt.Errorf("invalid LOG_MIN_LEVEL, expected one of %s", strings.Join(logLevels, ", "))
+	}
+	p := &logPolicy{
+		minLevel: minLevel,
+		samples:  make(map[string]float64),
+		dropped:  metrics.counter("broker_logs_dropped_total", "Log actions dropped by level or sampling."),
+	}
+	for _, level := range logLevels {
+		key := "LOG_SAMPLE_" + strings.ToUpper(level)
+		rate, err := strconv.ParseFloat(getEnv(key, "1"), 64)
+		if err != nil || rate < 0 || rate > 1 {
+			return nil, fmt.Errorf("invalid %s, expected a rate between 0 and 1", key)
+		}
+		p.samples[level] = rate
+	}
+	return p, nil
+}
+
+// prepareLog fills in the level and timestamp of request and reports
+// whether it should be logged.
+func (c *Config) prepareLog(request *logType) (bool, error) {
+	if request.Level == "" {
+		request.Level = LOG_DEFAULT_LEVEL
+	}
+	request.Level = strings.ToLower(request.Level)
+	rank := logLevelRank(request.Level)
+	if rank < 0 {
+		return false, fmt.Errorf("Invalid log level %q", request.Level)
+	}
+	if request.Timestamp == nil {
+		now := time.Now().UTC()
+		request.Timestamp = &now
+	}
+	if rank < c.logPolicy.minLevel || logSample(*request) >= c.logPolicy.samples[request.Level] {
+		c.logPolicy.dropped.inc()
+		return false, nil
+	}
+	return true, nil
+}
+
+// logSample maps request to a number in [0, 1) to sample it by. It is
+// derived from the log rather than random, so a log that was queued is
+// kept again when the worker prepares it.
+func logSample(request logType) float64 {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s\x00%s\x00%s\x00%s\x00%d", request.Name, request.Message, request.Level, request.Source, request.Timestamp.UnixNano())
+	return float64(h.Sum64()>>11) / (1 << 53)
+}
+
+// loadLogTransports reads the transports of LOG_TRANSPORTS, in the order
+// they are tried.
+func loadLogTransports() ([]string, error) {
+	var transports []string
+	for _, transport := range strings.Split(getEnv("LOG_TRANSPORTS", LOG_TRANSPORTS), ",") {
+		transport = strings.TrimSpace(transport)
+		switch transport {
+		case logViaHTTP, logViaGRPC, logViaQueue:
+			transports = append(transports, transport)
+		default:
+			return nil, fmt.Errorf("invalid LOG_TRANSPORTS %q, expected http, grpc or queue", transport)
+		}
+	}
+	return transports, nil
+}
+
+// logRequestGRPC maps request to the gRPC log request. Field values
+// that aren't strings are sent as JSON.
+func logRequestGRPC(request logType) *logging.LogRequest {
+	fields := make(map[string]string, len(request.Fields))
+	for k, v := range request.Fields {
+		if s, ok := v.(string); ok {
+			fields[k] = s
+			continue
+		}
+		b, _ := json.Marshal(v)
+		fields[k] = string(b)
+	}
+	out := &logging.LogRequest{
+		Name:   request.Name,
+		Data:   request.Message,
+		Level:  request.Level,
+		Source: request.Source,
+		Fields: fields,
+	}
+	if request.Timestamp != nil {
+		out.Timestamp = timestamppb.New(*request.Timestamp)
+	}
+	return out
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLoadLogTransports(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    []string
+		wantErr bool
+	}{
+		{"http", []string{logViaHTTP}, false},
+		{"grpc, http ,queue", []string{logViaGRPC, logViaHTTP, logViaQueue}, false},
+		{"http,smtp", nil, true},
+		{"", []string{logViaHTTP}, false},
+	}
+	for _, tt := range tests {
+		t.Setenv("LOG_TRANSPORTS", tt.value)
+		got, err := loadLogTransports()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q: err = %v, want error %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: got %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestHandleLoggingTransports(t *testing.T) {
+	var status atomic.Int32
+	var calls atomic.Int32
+	logging := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		code := int(status.Load())
+		w.WriteHeader(code)
+		if code != http.StatusOK {
+			w.Write([]byte(`{"error":true,"message":"failed"}`))
+			return
+		}
+		w.Write([]byte(`{"error":false,"message":"logged"}`))
+	}))
+	defer logging.Close()
+
+	policy, err := loadLogPolicy(newMetricsRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	redactor, err := loadRedactor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	jobs, err := newJobStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		transports []string
+		status     int
+		outbox     bool
+		want       string
+		wantErr    bool
+	}{
+		{"http", []string{logViaHTTP, logViaQueue}, http.StatusOK, true, "Logged", false},
+		{"falls back to the queue", []string{logViaHTTP, logViaQueue}, http.StatusInternalServerError, true, "Log queued", false},
+		{"queue first", []string{logViaQueue, logViaHTTP}, http.StatusOK, true, "Log queued", false},
+		{"worker skips the queue", []string{logViaQueue, logViaHTTP}, http.StatusOK, false, "Logged", false},
+		{"every transport fails", []string{logViaHTTP, logViaQueue}, http.StatusInternalServerError, false, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status.Store(int32(tt.status))
+			c := &Config{
+				logPolicy:     policy,
+				redactor:      redactor,
+				logTransports: tt.transports,
+				jobs:          jobs,
+				services: map[string]*service{
+					loggingService: newTestService(&staticResolver{addrs: []string{strings.TrimPrefix(logging.URL, "http://")}}, roundRobin),
+				},
+			}
+			if tt.outbox {
+				c.outbox = openTestOutbox(t, t.TempDir())
+			}
+			payload, err := c.handleLogging(context.Background(), logType{Name: "event", Message: "message"})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if payload.Message != tt.want {
+				t.Errorf("got %q, want %q", payload.Message, tt.want)
+			}
+		})
+	}
+	if calls.Load() == 0 {
+		t.Error("the logging service was never called")
+	}
+}
+
+func TestLogRequestGRPC(t *testing.T) {
+	timestamp := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	got := logRequestGRPC(logType{
+		Name:      "event",
+		Message:   "message",
+		Level:     "warn",
+		Timestamp: &timestamp,
+		Source:    "api",
+		Fields:    map[string]any{"user": "ann", "count": 2, "tags": []string{"a"}},
+	})
+	want := map[string]string{"user": "ann", "count": "2", "tags": `["a"]`}
+	if got.Name != "event" || got.Data != "message" || got.Level != "warn" || got.Source != "api" || !got.Timestamp.AsTime().Equal(timestamp) {
+		t.Errorf("got %v", got)
+	}
+	if !reflect.DeepEqual(got.Fields, want) {
+		t.Errorf("fields %v, want %v", got.Fields, want)
+	}
+}
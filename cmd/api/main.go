@@ -1,19 +1,46 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
 	"time"
 
 	amqp "github.com/rabbitmq/amqp091-go"
 )
 
 type Config struct {
-	conn *amqp.Connection
-	ch   *amqp.Channel
+	mu            sync.Mutex
+	amqp          *amqpConfig
+	conn          *amqp.Connection
+	ch            *amqp.Channel
+	queue         string
+	services      map[string]*service
+	jobs          *jobStore
+	idempotency   *idempotencyStore
+	outbox        *outbox
+	delivery      map[string]deliveryPolicy
+	workflows     *workflowEngine
+	proxyRoutes   []proxyRoute
+	cache         *responseCache
+	attachments   *attachmentLimits
+	templates     *mailTemplates
+	recipients    *recipientLimits
+	smtp          *smtpTransport
+	suppressions  *suppressionStore
+	logPolicy     *logPolicy
+	logBuffer     *logBuffer
+	logTransports []string
+	redactor      *redactor
+	keys          *keyring
+	metrics       *metricsRegistry
 }
 
 const (
@@ -24,39 +51,201 @@ const (
 
 const queneName = "broker"
 
+// shutdownTimeout bounds how long the server waits for requests in
+// flight when it is stopped.
+const shutdownTimeout = 30 * time.Second
+
 func main() {
-	// connect to rabbit mq
-	conn, err := connectToRabbit()
+	command := "serve"
+	if len(os.Args) > 1 {
+		command = os.Args[1]
+	}
+	switch command {
+	case "serve":
+		serve()
+	case "worker":
+		work()
+	default:
+		fmt.Printf("unknown command %s, expected serve or worker\n", command)
+		os.Exit(2)
+	}
+}
+
+// newConfig connects to rabbit mq and loads the rest of the
+// configuration, which both the server and the worker need.
+func newConfig() *Config {
+	amqpCfg, err := loadAMQPConfig()
 	if err != nil {
-		log.Panic("failed to connect to rabbit mq")
+		log.Panic("invalid rabbit mq configuration: ", err)
+	}
+	conn, err := connectToRabbit(amqpCfg)
+	if err != nil {
+		log.Panic("failed to connect to rabbit mq: ", err)
 	}
-	defer conn.Close()
 	ch, err := declareChannel(conn)
 	if err != nil {
 		log.Panic("failed to declare channel")
 	}
-	c := Config{conn: conn, ch: ch}
+	c := loadConfig()
+	c.amqp, c.conn, c.ch = amqpCfg, conn, ch
+	return c
+}
+
+// loadConfig sets up the downstream services and everything an action
+// needs to run, without rabbit mq.
+func loadConfig() *Config {
+	services, err := newServices()
+	if err != nil {
+		log.Panic("failed to configure downstream services: ", err)
+	}
+	templates, err := loadMailTemplates()
+	if err != nil {
+		log.Panic("failed to load mail templates: ", err)
+	}
+	recipients, err := loadRecipientLimits()
+	if err != nil {
+		log.Panic("failed to configure mail recipients: ", err)
+	}
+	metrics := newMetricsRegistry()
+	smtp, err := loadSMTPTransport(metrics)
+	if err != nil {
+		log.Panic("failed to configure smtp: ", err)
+	}
+	logPolicy, err := loadLogPolicy(metrics)
+	if err != nil {
+		log.Panic("failed to configure log levels: ", err)
+	}
+	logTransports, err := loadLogTransports()
+	if err != nil {
+		log.Panic("failed to configure log transports: ", err)
+	}
+	redactor, err := loadRedactor()
+	if err != nil {
+		log.Panic("failed to configure redaction: ", err)
+	}
+	keys, err := loadKeyring()
+	if err != nil {
+		log.Panic("failed to load message encryption keys: ", err)
+	}
+	suppressions, err := openSuppressionStore()
+	if err != nil {
+		log.Panic("failed to open suppression list: ", err)
+	}
+	// the worker reads stored attachments when it sends a queued email
+	attachments, err := loadAttachmentLimits()
+	if err != nil {
+		log.Panic("failed to configure attachments: ", err)
+	}
+	queue, _ := workQueue()
+	c := &Config{
+		queue:         queue,
+		services:      services,
+		metrics:       metrics,
+		templates:     templates,
+		recipients:    recipients,
+		attachments:   attachments,
+		smtp:          smtp,
+		suppressions:  suppressions,
+		logPolicy:     logPolicy,
+		logTransports: logTransports,
+		redactor:      redactor,
+		keys:          keys,
+	}
+	if c.logBuffer, err = newLogBuffer(c); err != nil {
+		log.Panic("failed to configure log buffering: ", err)
+	}
+	return c
+}
+
+func serve() {
+	c := newConfig()
+	defer c.conn.Close()
+	var err error
+	if c.jobs, err = newJobStore(); err != nil {
+		log.Panic("failed to configure job store: ", err)
+	}
+	if c.idempotency, err = newIdempotencyStore(); err != nil {
+		log.Panic("failed to configure idempotency keys: ", err)
+	}
+	if c.outbox, err = openOutbox(); err != nil {
+		log.Panic("failed to open outbox: ", err)
+	}
+	if c.delivery, err = loadDeliveryPolicies(); err != nil {
+		log.Panic("failed to configure message priorities: ", err)
+	}
+	if c.workflows, err = newWorkflowEngine(c); err != nil {
+		log.Panic("failed to load workflows: ", err)
+	}
+	if c.proxyRoutes, err = loadProxyRoutes(c.services); err != nil {
+		log.Panic("failed to load proxy routes: ", err)
+	}
+	if c.cache, err = newResponseCache(c.metrics); err != nil {
+		log.Panic("failed to configure response cache: ", err)
+	}
+	if c.attachments.mode == "store" {
+		go c.sweepAttachments()
+	}
+	c.metrics.gauge("broker_outbox_backlog_messages", "Messages waiting in the outbox.", func() float64 {
+		pending, _ := c.outbox.depth()
+		return float64(pending)
+	})
+	c.metrics.gauge("broker_outbox_backlog_bytes", "Bytes waiting in the outbox.", func() float64 {
+		_, size := c.outbox.depth()
+		return float64(size)
+	})
+	if err := c.consumeReplies(); err != nil {
+		log.Panic("failed to consume job replies: ", err)
+	}
+	if err := declareParkingQueue(c.ch); err != nil {
+		log.Panic("failed to declare parking lot queue: ", err)
+	}
+	go c.relayOutbox()
+
+	// the log buffer is stopped only once the server has finished the
+	// requests in flight, so their logs make the last flush
+	logCtx, stopLogs := context.WithCancel(context.Background())
+	var logs sync.WaitGroup
+	if c.logBuffer != nil {
+		logs.Add(1)
+		go func() {
+			defer logs.Done()
+			c.logBuffer.run(logCtx)
+		}()
+	}
 	h := c.Newhandler()
+	srv := &http.Server{Addr: ":8080", Handler: h.router}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	shutdown := make(chan struct{})
+	go func() {
+		defer close(shutdown)
+		<-ctx.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Println("server shutdown:", err)
+		}
+	}()
 	log.Println("server started at port 8080...")
-	err = http.ListenAndServe(":8080", h.router)
+	err = srv.ListenAndServe()
 	if errors.Is(err, http.ErrServerClosed) {
+		<-shutdown
 		fmt.Printf("server closed\n")
-	} else if err != nil {
+	}
+	stopLogs()
+	logs.Wait()
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
 		fmt.Printf("error starting server %s \n", err)
 		os.Exit(1)
 	}
 }
 
-func connectToRabbit() (*amqp.Connection, error) {
+func connectToRabbit(cfg *amqpConfig) (*amqp.Connection, error) {
 	count := 1
 	backoff := time.Second
-	log.Println("Connecting to Rabbit...")
+	log.Printf("Connecting to Rabbit at %s...\n", cfg.url().Redacted())
 	for {
-		rabbit_pass := getEnv("RABBITMQ_DEFAULT_PASS", RABBITMQ_DEFAULT_PASS)
-		rabbit_user := getEnv("RABBITMQ_DEFAULT_USER", RABBITMQ_DEFAULT_USER)
-		rabbit_url := getEnv("RABBITMQ_URL", RABBITMQ_URL)
-		rabbit_addr := "amqp://" + rabbit_pass + ":" + rabbit_user + "@" + rabbit_url + ":5672/"
-		conn, err := amqp.Dial(rabbit_addr)
+		conn, err := cfg.dial()
 		if err != nil {
 			count++
 			backoff = time.Duration(count*count) * time.Second
@@ -77,6 +266,9 @@ func declareChannel(conn *amqp.Connection) (*amqp.Channel, error) {
 	if err != nil {
 		return nil, err
 	}
+	if err := ch.Confirm(false); err != nil {
+		return nil, err
+	}
 	_, err = ch.QueueDeclare(
 		queneName, // name
 		false,     // durable
@@ -88,6 +280,19 @@ func declareChannel(conn *amqp.Connection) (*amqp.Channel, error) {
 	if err != nil {
 		return nil, err
 	}
+	if queue, args := workQueue(); queue != queneName {
+		_, err = ch.QueueDeclare(
+			queue, // name
+			false, // durable
+			false, // delete when unused
+			false, // exclusive
+			false, // no-wait
+			args,  // arguments
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
 	return ch, nil
 }
 
@@ -98,3 +303,35 @@ func getEnv(key, default_value string) string {
 	}
 	return value
 }
+
+func getEnvBool(key string, default_value bool) (bool, error) {
+	value := os.Getenv(key)
+	if len(value) == 0 {
+		return default_value, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s: %w", key, err)
+	}
+	return b, nil
+}
+
+func getEnvInt(key string, default_value int) (int, error) {
+	value := os.Getenv(key)
+	if len(value) == 0 {
+		return default_value, nil
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", key, err)
+	}
+	return i, nil
+}
+
+func getEnvDuration(key, default_value string) (time.Duration, error) {
+	d, err := time.ParseDuration(getEnv(key, default_value))
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", key, err)
+	}
+	return d, nil
+}
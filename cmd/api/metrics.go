@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// counter is a monotonically increasing metric.
+type counter struct {
+	value atomic.Int64
+}
+
+func (m *counter) inc() {
+	m.value.Add(1)
+}
+
+func (m *counter) add(n int) {
+	m.value.Add(int64(n))
+}
+
+type metric struct {
+	name  string
+	help  string
+	kind  string
+	value func() float64
+}
+
+// metricsRegistry collects the broker's metrics and serves them in the
+// Prometheus text format on /metrics.
+type metricsRegistry struct {
+	mu      sync.Mutex
+	metrics map[string]metric
+}
+
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{metrics: make(map[string]metric)}
+}
+
+// gauge registers a metric whose value is read from f on every scrape.
+func (m *metricsRegistry) gauge(name, help string, f func() float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.metrics[name] = metric{name: name, help: help, kind: "gauge", value: f}
+}
+
+// counter registers and returns a new counter.
+func (m *metricsRegistry) counter(name, help string) *counter {
+	cnt := &counter{}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.metrics[name] = metric{name: name, help: help, kind: "counter", value: func() float64 {
+		return float64(cnt.value.Load())
+	}}
+	return cnt
+}
+
+func (m *metricsRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	names := make([]string, 0, len(m.metrics))
+	for name := range m.metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		metric := m.metrics[name]
+		fmt.Fprintf(&b, "# HELP %s %s\n", metric.name, metric.help)
+		fmt.Fprintf(&b, "# TYPE %s %s\n", metric.name, metric.kind)
+		fmt.Fprintf(&b, "%s %g\n", metric.name, metric.value())
+	}
+	m.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write([]byte(b.String()))
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// requireToken accepts requests carrying one of the bearer tokens listed
+// in API_TOKENS. The token is meant for the broker only, so the header is
+// removed before the request is passed on, and proxied, upstream.
+func (c *Config) requireToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !hasBearerToken(r, strings.Split(os.Getenv("API_TOKENS"), ",")...) {
+			c.ErrorJSON(w, errors.New("Unauthorized"), http.StatusUnauthorized)
+			return
+		}
+		r.Header.Del("Authorization")
+		next.ServeHTTP(w, r)
+	})
+}
+
+// hasBearerToken reports whether r carries one of tokens as its bearer
+// token. Every token is compared in constant time, empty ones never
+// match.
+func hasBearerToken(r *http.Request, tokens ...string) bool {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return false
+	}
+	given := []byte(strings.TrimPrefix(header, "Bearer "))
+	match := 0
+	for _, token := range tokens {
+		if token = strings.TrimSpace(token); token != "" {
+			match |= subtle.ConstantTimeCompare(given, []byte(token))
+		}
+	}
+	return match == 1
+}
+
+// rateLimiter is a token bucket per client address.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	swept   time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{rate: rate, burst: float64(burst), buckets: make(map[string]*bucket)}
+}
+
+func (l *rateLimiter) allow(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	// forget clients that have been idle long enough to be full again
+	if now.Sub(l.swept) > time.Minute {
+		for k, b := range l.buckets {
+			if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+				delete(l.buckets, k)
+			}
+		}
+		l.swept = now
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// rateLimit rejects clients sending more than the limiter allows.
+func (c *Config) rateLimit(l *rateLimiter) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			host, _, err := net.SplitHostPort(r.RemoteAddr)
+			if err != nil {
+				host = r.RemoteAddr
+			}
+			if !l.allow(host) {
+				w.Header().Set("Retry-After", "1")
+				c.ErrorJSON(w, errors.New("Too many requests"), http.StatusTooManyRequests)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHasBearerToken(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		tokens []string
+		want   bool
+	}{
+		{"match", "Bearer b", []string{"a", " b "}, true},
+		{"no match", "Bearer c", []string{"a", "b"}, false},
+		{"without scheme", "b", []string{"b"}, false},
+		{"other scheme", "Basic b", []string{"b"}, false},
+		{"empty token", "Bearer ", []string{""}, false},
+		{"no tokens", "Bearer b", nil, false},
+		{"no header", "", []string{"b"}, false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if tt.header != "" {
+			r.Header.Set("Authorization", tt.header)
+		}
+		if got := hasBearerToken(r, tt.tokens...); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRequireTokenStripsAuthorization(t *testing.T) {
+	t.Setenv("API_TOKENS", "one,two")
+	var upstream *http.Request
+	handler := (&Config{}).requireToken(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstream = r
+	}))
+	tests := []struct {
+		header string
+		want   int
+	}{
+		{"Bearer two", http.StatusOK},
+		{"Bearer three", http.StatusUnauthorized},
+		{"", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		upstream = nil
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Authorization", tt.header)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%q: got %d, want %d", tt.header, w.Code, tt.want)
+		}
+		if upstream != nil && upstream.Header.Get("Authorization") != "" {
+			t.Errorf("%q: token passed on", tt.header)
+		}
+	}
+}
+
+func TestTokenEndpoints(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     string
+		token   string
+		handler func(c *Config) http.Handler
+		header  string
+		want    int
+	}{
+		{"admin disabled", "ADMIN_TOKEN", "", adminHandler, "Bearer ", http.StatusForbidden},
+		{"admin", "ADMIN_TOKEN", "secret", adminHandler, "Bearer secret", http.StatusOK},
+		{"admin wrong token", "ADMIN_TOKEN", "secret", adminHandler, "Bearer other", http.StatusUnauthorized},
+		{"webhook disabled", "SUPPRESSION_WEBHOOK_TOKEN", "", webhookHandler, "Bearer ", http.StatusForbidden},
+		{"webhook wrong token", "SUPPRESSION_WEBHOOK_TOKEN", "secret", webhookHandler, "secret", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Setenv(tt.env, tt.token)
+		r := httptest.NewRequest(http.MethodPost, "/", nil)
+		r.Header.Set("Authorization", tt.header)
+		w := httptest.NewRecorder()
+		tt.handler(&Config{}).ServeHTTP(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, w.Code, tt.want)
+		}
+	}
+}
+
+func adminHandler(c *Config) http.Handler {
+	return c.adminOnly(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+}
+
+func webhookHandler(c *Config) http.Handler {
+	return http.HandlerFunc(c.handleMailEvents)
+}
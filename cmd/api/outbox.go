@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	OUTBOX_DIR       = "outbox"
+	OUTBOX_MAX_BYTES = 64 * 1024 * 1024
+	OUTBOX_RETRY     = "5s"
+)
+
+const (
+	outboxLogFile    = "outbox.log"
+	outboxOffsetFile = "outbox.offset"
+	outboxHeaderSize = 8
+	outboxBatchSize  = 100
+)
+
+// outboxGobBatch prefixes the frame payloads, a batch of records encoded
+// with gob.
+const outboxGobBatch = 2
+
+func init() {
+	// the types rabbit allows in headers besides the basic ones, so they
+	// come back from the outbox as they went in
+	gob.Register(amqp.Table{})
+	gob.Register([]interface{}{})
+	gob.Register(time.Time{})
+	gob.Register(amqp.Decimal{})
+}
+
+var errOutboxFull = errors.New("outbox is full")
+
+// outboxRecord is a message waiting to be published. It is stored with
+// gob, which keeps the types of the header values; JSON would turn every
+// number into a float64.
+type outboxRecord struct {
+	Exchange   string
+	RoutingKey string
+	Msg        amqp.Publishing
+}
+
+// outboxEntry is a record read from the outbox. end is the end of the
+// frame it was stored in, which it shares with the rest of its batch.
+type outboxEntry struct {
+	record outboxRecord
+	end    int64
+}
+
+// outbox is an append-only log of messages on local disk. The records
+// of every append are framed together as a 4 byte length, a 4 byte CRC32
+// and the encoded batch, so a batch cut short by a crash is dropped as a
+// whole. The offset file points at the first record not yet published;
+// once everything is published the log is truncated.
+type outbox struct {
+	mu       sync.Mutex
+	dir      string
+	file     *os.File
+	size     int64
+	offset   int64
+	pending  int
+	maxBytes int64
+	notify   chan struct{}
+}
+
+func openOutbox() (*outbox, error) {
+	dir := getEnv("OUTBOX_DIR", OUTBOX_DIR)
+	maxBytes, err := getEnvInt("OUTBOX_MAX_BYTES", OUTBOX_MAX_BYTES)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(filepath.Join(dir, outboxLogFile), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	o := &outbox{
+		dir:      dir,
+		file:     file,
+		maxBytes: int64(maxBytes),
+		notify:   make(chan struct{}, 1),
+	}
+	if err := o.recover(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if o.pending > 0 {
+		log.Printf("outbox has %d messages waiting to be published\n", o.pending)
+		o.signal()
+	}
+	return o, nil
+}
+
+// recover loads the offset and counts the pending records, cutting off
+// a partially written batch left behind by a crash.
+func (o *outbox) recover() error {
+	data, err := os.ReadFile(filepath.Join(o.dir, outboxOffsetFile))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(data) > 0 {
+		if o.offset, err = strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64); err != nil {
+			return err
+		}
+	}
+	info, err := o.file.Stat()
+	if err != nil {
+		return err
+	}
+	o.size = info.Size()
+	if o.offset > o.size {
+		o.offset = o.size
+	}
+
+	var end int64
+	if o.pending, end = o.scan(o.offset); end < o.size {
+		log.Printf("outbox: dropping corrupt tail at offset %d\n", end)
+		if err := o.file.Truncate(end); err != nil {
+			return err
+		}
+		o.size = end
+	}
+	return nil
+}
+
+// scan counts the records of the frames from pos on, passing over
+// corrupt ones, and returns where the last valid frame ends.
+func (o *outbox) scan(pos int64) (int, int64) {
+	count, end := 0, pos
+	for pos < o.size {
+		recs, next, err := o.readAt(pos)
+		if err != nil {
+			pos = o.nextFrame(pos)
+			continue
+		}
+		count += len(recs)
+		pos, end = next, next
+	}
+	return count, end
+}
+
+// nextFrame returns where the first valid frame after pos starts, or
+// the end of the log if there is none.
+func (o *outbox) nextFrame(pos int64) int64 {
+	for next := pos + 1; next < o.size; next++ {
+		if _, _, err := o.readAt(next); err == nil {
+			return next
+		}
+	}
+	return o.size
+}
+
+// readAt returns the records of the frame at pos and where it ends.
+func (o *outbox) readAt(pos int64) ([]outboxRecord, int64, error) {
+	header := make([]byte, outboxHeaderSize)
+	if _, err := o.file.ReadAt(header, pos); err != nil {
+		return nil, 0, err
+	}
+	length := int64(binary.BigEndian.Uint32(header[:4]))
+	if pos+outboxHeaderSize+length > o.size {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	payload := make([]byte, length)
+	if _, err := o.file.ReadAt(payload, pos+outboxHeaderSize); err != nil {
+		return nil, 0, err
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:]) {
+		return nil, 0, errors.New("checksum mismatch")
+	}
+	recs, err := decodeOutboxFrame(payload)
+	if err != nil {
+		return nil, 0, err
+	}
+	return recs, pos + outboxHeaderSize + length, nil
+}
+
+func encodeOutboxFrame(recs []outboxRecord) ([]byte, error) {
+	buf := bytes.NewBuffer([]byte{outboxGobBatch})
+	if err := gob.NewEncoder(buf).Encode(recs); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeOutboxFrame(payload []byte) ([]outboxRecord, error) {
+	if len(payload) == 0 || payload[0] != outboxGobBatch {
+		return nil, errors.New("unknown record format")
+	}
+	var recs []outboxRecord
+	if err := gob.NewDecoder(bytes.NewReader(payload[1:])).Decode(&recs); err != nil {
+		return nil, err
+	}
+	if len(recs) == 0 {
+		return nil, errors.New("empty batch")
+	}
+	return recs, nil
+}
+
+// append durably stores recs and wakes up the relay. Either all of the
+// records are stored or none of them.
+func (o *outbox) append(recs ...outboxRecord) error {
+	if len(recs) == 0 {
+		return nil
+	}
+	payload, err := encodeOutboxFrame(recs)
+	if err != nil {
+		return err
+	}
+	frame := make([]byte, outboxHeaderSize, outboxHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(frame[:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(frame[4:8], crc32.ChecksumIEEE(payload))
+	frame = append(frame, payload...)
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.size-o.offset+int64(len(frame)) > o.maxBytes {
+		return errOutboxFull
+	}
+	_, err = o.file.Write(frame)
+	if err == nil {
+		err = o.file.Sync()
+	}
+	if err != nil {
+		// drop whatever part of the frame made it to disk, so the next
+		// append doesn't land behind it
+		o.file.Truncate(o.size)
+		return err
+	}
+	o.size += int64(len(frame))
+	o.pending += len(recs)
+	o.signal()
+	return nil
+}
+
+func (o *outbox) signal() {
+	select {
+	case o.notify <- struct{}{}:
+	default:
+	}
+}
+
+// read returns the records of the frames starting at the current
+// offset, at least n of them unless the outbox holds fewer. A batch is
+// always returned whole. A corrupt frame at the offset is skipped, as
+// it would otherwise hold up everything behind it.
+func (o *outbox) read(n int) ([]outboxEntry, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var entries []outboxEntry
+	pos := o.offset
+	for pos < o.size && len(entries) < n {
+		recs, end, err := o.readAt(pos)
+		if err != nil && len(entries) > 0 {
+			// the records before it are published first
+			break
+		}
+		if err != nil {
+			next := o.nextFrame(pos)
+			log.Printf("outbox: skipping corrupt frame at offset %d to %d: %v\n", pos, next, err)
+			pending, _ := o.scan(next)
+			if err := o.advance(next, o.pending-pending); err != nil {
+				return nil, err
+			}
+			pos = o.offset
+			continue
+		}
+		for _, rec := range recs {
+			entries = append(entries, outboxEntry{record: rec, end: end})
+		}
+		pos = end
+	}
+	return entries, nil
+}
+
+// ack marks the n records before end as published.
+func (o *outbox) ack(end int64, n int) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.advance(end, n)
+}
+
+// advance moves the offset to end, past n records. The caller must hold
+// o.mu.
+func (o *outbox) advance(end int64, n int) error {
+	o.offset = end
+	o.pending -= n
+	if o.offset == o.size {
+		// the truncation must be on disk before an offset of 0 is, or
+		// a crash would publish the log again
+		if err := o.file.Truncate(0); err != nil {
+			return err
+		}
+		if err := o.file.Sync(); err != nil {
+			return err
+		}
+		o.offset, o.size = 0, 0
+	}
+	return o.writeOffset()
+}
+
+// writeOffset durably replaces the offset file.
+func (o *outbox) writeOffset() error {
+	tmp := filepath.Join(o.dir, outboxOffsetFile+".tmp")
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = file.WriteString(strconv.FormatInt(o.offset, 10))
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(o.dir, outboxOffsetFile)); err != nil {
+		return err
+	}
+	dir, err := os.Open(o.dir)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// depth returns the number of pending records and their size in bytes.
+func (o *outbox) depth() (int, int64) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.pending, o.size - o.offset
+}
+
+// relayOutbox publishes the outbox in order whenever something is added
+// and retries periodically while RabbitMQ is unreachable.
+func (c *Config) relayOutbox() {
+	retry, err := getEnvDuration("OUTBOX_RETRY", OUTBOX_RETRY)
+	if err != nil {
+		log.Panic(err)
+	}
+	ticker := time.NewTicker(retry)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.outbox.notify:
+		case <-ticker.C:
+		}
+		c.flushOutbox()
+	}
+}
+
+// flushOutbox publishes the outbox in batches of outboxBatchSize. The
+// messages of a batch are published at once and their confirms awaited
+// together, and the confirmed prefix is acked.
+func (c *Config) flushOutbox() {
+	for {
+		entries, err := c.outbox.read(outboxBatchSize)
+		if err != nil {
+			log.Println("outbox read failed:", err)
+		}
+		if len(entries) == 0 {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		confirmed, err := c.publishBatch(ctx, entries)
+		cancel()
+		confirmed = wholeFrames(entries, confirmed)
+		if confirmed > 0 {
+			if err := c.outbox.ack(entries[confirmed-1].end, confirmed); err != nil {
+				log.Println("outbox ack failed:", err)
+				return
+			}
+		}
+		if err != nil {
+			log.Println("outbox publish failed, will retry:", err)
+			return
+		}
+	}
+}
+
+// wholeFrames returns how many of the first n entries can be acked. Only
+// whole frames can, the confirmed part of a batch is published again
+// with the rest of it.
+func wholeFrames(entries []outboxEntry, n int) int {
+	for n > 0 && n < len(entries) && entries[n].end == entries[n-1].end {
+		n--
+	}
+	return n
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func openTestOutbox(t *testing.T, dir string) *outbox {
+	t.Helper()
+	t.Setenv("OUTBOX_DIR", dir)
+	o, err := openOutbox()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { o.file.Close() })
+	return o
+}
+
+func testRecord(id string) outboxRecord {
+	return outboxRecord{RoutingKey: "broker", Msg: amqp.Publishing{MessageId: id, Body: []byte(id)}}
+}
+
+func TestOutboxKeepsHeaderTypes(t *testing.T) {
+	timestamp := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name  string
+		value interface{}
+	}{
+		{"bool", true},
+		{"int8", int8(-8)},
+		{"uint8", uint8(8)},
+		{"int16", int16(-16)},
+		{"uint16", uint16(16)},
+		{"int32", int32(-32)},
+		{"uint32", uint32(32)},
+		{"int64", int64(1) << 40},
+		{"float32", float32(1.5)},
+		{"float64", 2.5},
+		{"string", "s"},
+		{"bytes", []byte{0, 1, 2}},
+		{"decimal", amqp.Decimal{Scale: 2, Value: 314}},
+		{"time", timestamp},
+		{"table", amqp.Table{"count": int64(1), "reason": "expired"}},
+		{"array", []interface{}{amqp.Table{"count": int32(2)}, "x"}},
+		{"nil", nil},
+	}
+	dir := t.TempDir()
+	o := openTestOutbox(t, dir)
+	msg := amqp.Publishing{
+		Headers:      amqp.Table{},
+		ContentType:  "application/json",
+		DeliveryMode: amqp.Persistent,
+		Priority:     3,
+		Expiration:   "1000",
+		MessageId:    "id",
+		Timestamp:    timestamp,
+		Body:         []byte(`{"action":"send"}`),
+	}
+	for _, tt := range tests {
+		msg.Headers[tt.name] = tt.value
+	}
+	if err := o.append(outboxRecord{RoutingKey: "broker", Msg: msg}); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened := openTestOutbox(t, dir)
+	entries, err := reopened.read(1)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("read %v, %v", entries, err)
+	}
+	got := entries[0].record.Msg
+	for _, tt := range tests {
+		if value := got.Headers[tt.name]; !reflect.DeepEqual(value, tt.value) {
+			t.Errorf("%s: got %#v, want %#v", tt.name, value, tt.value)
+		}
+	}
+	got.Headers, msg.Headers = nil, nil
+	if !reflect.DeepEqual(got, msg) {
+		t.Errorf("got %+v, want %+v", got, msg)
+	}
+}
+
+func TestOutboxAck(t *testing.T) {
+	tests := []struct {
+		name        string
+		acked       int
+		wantPending int
+		wantSize    bool
+	}{
+		{"nothing", 0, 3, true},
+		{"some", 2, 1, true},
+		{"all", 3, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			o := openTestOutbox(t, dir)
+			for _, id := range []string{"a", "b", "c"} {
+				if err := o.append(testRecord(id)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			entries, err := o.read(outboxBatchSize)
+			if err != nil || len(entries) != 3 {
+				t.Fatalf("read %d, %v", len(entries), err)
+			}
+			if tt.acked > 0 {
+				if err := o.ack(entries[tt.acked-1].end, tt.acked); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			reopened := openTestOutbox(t, dir)
+			pending, size := reopened.depth()
+			if pending != tt.wantPending || (size > 0) != tt.wantSize {
+				t.Errorf("reopened with %d pending in %d bytes", pending, size)
+			}
+			entries, _ = reopened.read(outboxBatchSize)
+			if len(entries) > 0 && entries[0].record.Msg.MessageId != string(rune('a'+tt.acked)) {
+				t.Errorf("resumed at %s", entries[0].record.Msg.MessageId)
+			}
+		})
+	}
+}
+
+func TestOutboxDropsCorruptTail(t *testing.T) {
+	tests := []struct {
+		name   string
+		damage func(t *testing.T, path string, size int64)
+	}{
+		{"cut short", func(t *testing.T, path string, size int64) {
+			os.Truncate(path, size-3)
+		}},
+		{"flipped byte", func(t *testing.T, path string, size int64) {
+			f, err := os.OpenFile(path, os.O_RDWR, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			f.WriteAt([]byte{0xff}, size-1)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			o := openTestOutbox(t, dir)
+			o.append(testRecord("a"))
+			o.append(testRecord("b"))
+			_, size := o.depth()
+			tt.damage(t, filepath.Join(dir, outboxLogFile), size)
+
+			reopened := openTestOutbox(t, dir)
+			entries, err := reopened.read(outboxBatchSize)
+			if err != nil || len(entries) != 1 || entries[0].record.Msg.MessageId != "a" {
+				t.Fatalf("read %v, %v", entries, err)
+			}
+		})
+	}
+}
+
+func TestOutboxSkipsCorruptFrame(t *testing.T) {
+	for _, reopen := range []bool{false, true} {
+		dir := t.TempDir()
+		o := openTestOutbox(t, dir)
+		var ends []int64
+		for _, id := range []string{"a", "b", "c"} {
+			if err := o.append(testRecord(id)); err != nil {
+				t.Fatal(err)
+			}
+			_, size := o.depth()
+			ends = append(ends, size)
+		}
+		// flip the last byte of b
+		f, err := os.OpenFile(filepath.Join(dir, outboxLogFile), os.O_RDWR, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.WriteAt([]byte{0xff}, ends[1]-1)
+		f.Close()
+		if reopen {
+			o = openTestOutbox(t, dir)
+		}
+
+		var got []string
+		for i := 0; i < 3; i++ {
+			entries, err := o.read(outboxBatchSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) == 0 {
+				break
+			}
+			for _, entry := range entries {
+				got = append(got, entry.record.Msg.MessageId)
+			}
+			if err := o.ack(entries[len(entries)-1].end, len(entries)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if want := []string{"a", "c"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("reopen %v: read %v, want %v", reopen, got, want)
+		}
+		if pending, size := o.depth(); pending != 0 || size != 0 {
+			t.Errorf("reopen %v: %d pending in %d bytes after reading everything", reopen, pending, size)
+		}
+	}
+}
+
+func TestOutboxBatches(t *testing.T) {
+	// keep returns how much of the log survives, given where the batch
+	// starts and where it ends
+	tests := []struct {
+		name string
+		keep func(start, end int64) int64
+		want []string
+	}{
+		{"whole batch", func(start, end int64) int64 { return end }, []string{"a", "b", "c", "d"}},
+		{"last byte missing", func(start, end int64) int64 { return end - 1 }, []string{"a"}},
+		{"cut in the middle", func(start, end int64) int64 { return (start + end) / 2 }, []string{"a"}},
+		{"header only", func(start, end int64) int64 { return start + outboxHeaderSize }, []string{"a"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			o := openTestOutbox(t, dir)
+			if err := o.append(testRecord("a")); err != nil {
+				t.Fatal(err)
+			}
+			_, first := o.depth()
+			if err := o.append(testRecord("b"), testRecord("c"), testRecord("d")); err != nil {
+				t.Fatal(err)
+			}
+			_, size := o.depth()
+			if err := os.Truncate(filepath.Join(dir, outboxLogFile), tt.keep(first, size)); err != nil {
+				t.Fatal(err)
+			}
+
+			reopened := openTestOutbox(t, dir)
+			if pending, _ := reopened.depth(); pending != len(tt.want) {
+				t.Errorf("%d pending, want %d", pending, len(tt.want))
+			}
+			// reading one record past the first batch returns the next
+			// batch whole
+			entries, err := reopened.read(2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, entry := range entries {
+				got = append(got, entry.record.Msg.MessageId)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("read %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWholeFrames(t *testing.T) {
+	// a single record, a batch of three, a single record
+	entries := []outboxEntry{{end: 10}, {end: 40}, {end: 40}, {end: 40}, {end: 50}}
+	tests := []struct {
+		confirmed, want int
+	}{
+		{0, 0},
+		{1, 1},
+		{2, 1},
+		{3, 1},
+		{4, 4},
+		{5, 5},
+	}
+	for _, tt := range tests {
+		if got := wholeFrames(entries, tt.confirmed); got != tt.want {
+			t.Errorf("%d confirmed: got %d, want %d", tt.confirmed, got, tt.want)
+		}
+	}
+}
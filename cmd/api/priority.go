@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	QUEUE_MAX_PRIORITY = 10
+	MESSAGE_TTL_MAX    = "24h"
+)
+
+const (
+	priorityHeader = "X-Message-Priority"
+	ttlHeader      = "X-Message-TTL"
+)
+
+// deliveryPolicy holds the default priority and TTL of an action and the
+// highest values a client may ask for. A zero TTL means no expiration.
+type deliveryPolicy struct {
+	priority    int
+	maxPriority int
+	ttl         time.Duration
+	maxTTL      time.Duration
+}
+
+// urgent actions jump ahead of bulk logging by default
+var defaultPriorities = map[string]int{
+	Authorization: 5,
+	Send:          5,
+	Logging:       1,
+}
+
+// loadDeliveryPolicies reads PRIORITY_<ACTION>, PRIORITY_<ACTION>_MAX,
+// TTL_<ACTION> and TTL_<ACTION>_MAX, capped by QUEUE_MAX_PRIORITY and
+// MESSAGE_TTL_MAX.
+func loadDeliveryPolicies() (map[string]deliveryPolicy, error) {
+	queueMax, err := queueMaxPriority()
+	if err != nil {
+		return nil, err
+	}
+	ttlMax, err := getEnvDuration("MESSAGE_TTL_MAX", MESSAGE_TTL_MAX)
+	if err != nil {
+		return nil, err
+	}
+
+	policies := make(map[string]deliveryPolicy)
+	for _, action := range []string{Authorization, Logging, Send} {
+		prefix := strings.ToUpper(action)
+		var p deliveryPolicy
+		if p.priority, err = getEnvInt("PRIORITY_"+prefix, defaultPriorities[action]); err != nil {
+			return nil, err
+		}
+		if p.maxPriority, err = getEnvInt("PRIORITY_"+prefix+"_MAX", queueMax); err != nil {
+			return nil, err
+		}
+		if p.ttl, err = getEnvDuration("TTL_"+prefix, "0s"); err != nil {
+			return nil, err
+		}
+		if p.maxTTL, err = getEnvDuration("TTL_"+prefix+"_MAX", ttlMax.String()); err != nil {
+			return nil, err
+		}
+		p.maxPriority = clamp(p.maxPriority, 0, queueMax)
+		p.priority = clamp(p.priority, 0, p.maxPriority)
+		if p.maxTTL > ttlMax {
+			p.maxTTL = ttlMax
+		}
+		if p.ttl > p.maxTTL {
+			p.ttl = p.maxTTL
+		}
+		policies[action] = p
+	}
+	return policies, nil
+}
+
+// deliveryOptions returns the priority and expiration for a message from
+// the X-Message-Priority and X-Message-TTL headers, falling back to the
+// action defaults. Requested values above the caps are lowered to them.
+func (c *Config) deliveryOptions(r *http.Request, action string) (uint8, string, error) {
+	p := c.delivery[action]
+	priority, ttl := p.priority, p.ttl
+	if value := r.Header.Get(priorityHeader); value != "" {
+		requested, err := strconv.Atoi(value)
+		if err != nil || requested < 0 {
+			return 0, "", fmt.Errorf("invalid %s %q", priorityHeader, value)
+		}
+		priority = clamp(requested, 0, p.maxPriority)
+	}
+	if value := r.Header.Get(ttlHeader); value != "" {
+		requested, err := time.ParseDuration(value)
+		if err != nil || requested <= 0 {
+			return 0, "", fmt.Errorf("invalid %s %q", ttlHeader, value)
+		}
+		ttl = requested
+		if ttl > p.maxTTL {
+			ttl = p.maxTTL
+		}
+	}
+	return uint8(priority), expiration(ttl), nil
+}
+
+// expiration returns the AMQP expiration for ttl, in whole milliseconds,
+// or no expiration for a zero ttl.
+func expiration(ttl time.Duration) string {
+	if ttl <= 0 {
+		return ""
+	}
+	// round up, an expiration of 0 would drop the message at once
+	return strconv.FormatInt(int64((ttl+time.Millisecond-1)/time.Millisecond), 10)
+}
+
+// priorityQueueName is the queue used instead of the broker queue when
+// priorities are on. A queue's arguments can't change once it exists, so
+// the broker queue keeps the ones it always had.
+const priorityQueueName = "broker.priority"
+
+// workQueue returns the queue requests are published to and its
+// arguments: a priority queue unless QUEUE_MAX_PRIORITY is 0.
+func workQueue() (string, amqp.Table) {
+	queueMax, err := queueMaxPriority()
+	if err != nil || queueMax == 0 {
+		return queneName, nil
+	}
+	return priorityQueueName, amqp.Table{"x-max-priority": int32(queueMax)}
+}
+
+// queueMaxPriority reads QUEUE_MAX_PRIORITY, limited to the 1 to 255
+// rabbit allows, or 0 when priorities are off.
+func queueMaxPriority() (int, error) {
+	queueMax, err := getEnvInt("QUEUE_MAX_PRIORITY", QUEUE_MAX_PRIORITY)
+	if err != nil || queueMax <= 0 {
+		return 0, err
+	}
+	return clamp(queueMax, 1, 255), nil
+}
+
+func clamp(v, low, high int) int {
+	if v < low {
+		return low
+	}
+	if v > high {
+		return high
+	}
+	return v
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDeliveryOptions(t *testing.T) {
+	t.Setenv("TTL_SEND_MAX", "1h")
+	t.Setenv("PRIORITY_SEND_MAX", "7")
+	policies, err := loadDeliveryPolicies()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Config{delivery: policies}
+
+	tests := []struct {
+		name           string
+		priority, ttl  string
+		wantPriority   uint8
+		wantExpiration string
+		wantErr        bool
+	}{
+		{name: "defaults", wantPriority: 5},
+		{name: "requested", priority: "3", ttl: "30s", wantPriority: 3, wantExpiration: "30000"},
+		{name: "capped", priority: "9", ttl: "2h", wantPriority: 7, wantExpiration: "3600000"},
+		{name: "under a millisecond rounds up", ttl: "500us", wantPriority: 5, wantExpiration: "1"},
+		{name: "fractions round up", ttl: "1500us", wantPriority: 5, wantExpiration: "2"},
+		{name: "negative priority", priority: "-1", wantErr: true},
+		{name: "zero ttl", ttl: "0s", wantErr: true},
+		{name: "invalid ttl", ttl: "soon", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/handleviaqueue", nil)
+			if tt.priority != "" {
+				r.Header.Set(priorityHeader, tt.priority)
+			}
+			if tt.ttl != "" {
+				r.Header.Set(ttlHeader, tt.ttl)
+			}
+			priority, expiration, err := c.deliveryOptions(r, Send)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if priority != tt.wantPriority || expiration != tt.wantExpiration {
+				t.Errorf("got priority %d and expiration %q, want %d and %q", priority, expiration, tt.wantPriority, tt.wantExpiration)
+			}
+		})
+	}
+}
+
+func TestWorkQueue(t *testing.T) {
+	tests := []struct {
+		max  string
+		want string
+		args bool
+	}{
+		{"", priorityQueueName, true},
+		{"5", priorityQueueName, true},
+		{"0", queneName, false},
+		{"-3", queneName, false},
+		{"1000", priorityQueueName, true},
+	}
+	for _, tt := range tests {
+		t.Setenv("QUEUE_MAX_PRIORITY", tt.max)
+		queue, args := workQueue()
+		if queue != tt.want || (args != nil) != tt.args {
+			t.Errorf("QUEUE_MAX_PRIORITY=%q: got %s with %v", tt.max, queue, args)
+		}
+		if max, ok := args["x-max-priority"].(int32); ok && (max < 1 || max > 255) {
+			t.Errorf("QUEUE_MAX_PRIORITY=%q: x-max-priority %d", tt.max, max)
+		}
+	}
+}
+
+func TestPrioritiesFitTheQueue(t *testing.T) {
+	t.Setenv("QUEUE_MAX_PRIORITY", "1000")
+	t.Setenv("PRIORITY_SEND", "300")
+	policies, err := loadDeliveryPolicies()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := policies[Send]; p.priority != 255 || p.maxPriority != 255 {
+		t.Errorf("got priority %d up to %d, want 255", p.priority, p.maxPriority)
+	}
+	c := &Config{delivery: policies}
+	r := httptest.NewRequest("POST", "/handleviaqueue", nil)
+	r.Header.Set(priorityHeader, "700")
+	if priority, _, err := c.deliveryOptions(r, Send); err != nil || priority != 255 {
+		t.Errorf("got priority %d, %v, want 255", priority, err)
+	}
+}
+
+func TestQueueRequestExpires(t *testing.T) {
+	t.Setenv("TTL_LOGGING", "30s")
+	policies, err := loadDeliveryPolicies()
+	if err != nil {
+		t.Fatal(err)
+	}
+	jobs, err := newJobStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	redactor, err := loadRedactor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Config{delivery: policies, jobs: jobs, redactor: redactor, outbox: openTestOutbox(t, t.TempDir()), queue: priorityQueueName}
+	if _, err := c.queueRequest(requestType{Action: Logging, Log: logType{Name: "event"}}); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := c.outbox.read(1)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("read %v, %v", entries, err)
+	}
+	if msg := entries[0].record.Msg; msg.Expiration != "30000" || msg.Priority != 1 {
+		t.Errorf("got expiration %q and priority %d, want 30000 and 1", msg.Expiration, msg.Priority)
+	}
+}
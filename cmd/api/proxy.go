@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+const PROXY_ROUTES_FILE = "proxy.json"
+
+// proxyRoute forwards every request below Prefix to Upstream, which is
+// either the name of a discovered service or a base URL. The file in
+// PROXY_ROUTES_FILE holds a JSON list of routes, e.g.
+//
+//	[{"prefix": "/services/mail", "upstream": "mail", "strip_prefix": true, "timeout": "10s",
+//	  "auth": true, "rate_limit": 5, "burst": 10,
+//	  "set_headers": {"X-Forwarded-By": "broker"}, "remove_headers": ["Cookie"]}]
+type proxyRoute struct {
+	Prefix          string            `json:"prefix"`
+	Upstream        string            `json:"upstream"`
+	StripPrefix     bool              `json:"strip_prefix"`
+	Timeout         string            `json:"timeout"`
+	Cache           string            `json:"cache"`
+	Auth            bool              `json:"auth"`
+	RateLimit       float64           `json:"rate_limit"`
+	Burst           int               `json:"burst"`
+	SetHeaders      map[string]string `json:"set_headers"`
+	RemoveHeaders   []string          `json:"remove_headers"`
+	ResponseHeaders map[string]string `json:"response_headers"`
+
+	timeout  time.Duration
+	cacheTTL time.Duration
+	target   *url.URL
+}
+
+// builtinRoutes are the first path segments of the routes of Newhandler.
+// Proxy routes can't use them, as they would shadow or be shadowed by the
+// built-in ones.
+var builtinRoutes = []string{
+	"ping", "hello", "handle", "grpclog", "handleviaqueue", "events", "batch",
+	"mail", "attachments", "workflows", "jobs", "metrics", "admin",
+}
+
+// shadowsBuiltin reports whether prefix is below a built-in route.
+func shadowsBuiltin(prefix string) bool {
+	first, _, _ := strings.Cut(strings.TrimPrefix(prefix, "/"), "/")
+	for _, route := range builtinRoutes {
+		if first == route {
+			return true
+		}
+	}
+	return false
+}
+
+func loadProxyRoutes(services map[string]*service) ([]proxyRoute, error) {
+	path := getEnv("PROXY_ROUTES_FILE", PROXY_ROUTES_FILE)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var routes []proxyRoute
+	if err := json.Unmarshal(data, &routes); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for i := range routes {
+		route := &routes[i]
+		if !strings.HasPrefix(route.Prefix, "/") || route.Prefix == "/" {
+			return nil, fmt.Errorf("%s: invalid prefix %q", path, route.Prefix)
+		}
+		route.Prefix = strings.TrimSuffix(route.Prefix, "/")
+		if shadowsBuiltin(route.Prefix) {
+			return nil, fmt.Errorf("%s: prefix %q conflicts with a built-in route", path, route.Prefix)
+		}
+		if _, ok := services[route.Upstream]; !ok {
+			if route.target, err = url.Parse(route.Upstream); err != nil || route.target.Host == "" {
+				return nil, fmt.Errorf("%s: upstream %q is neither a service nor a URL", path, route.Upstream)
+			}
+		}
+		route.timeout = 30 * time.Second
+		if route.Timeout != "" {
+			if route.timeout, err = time.ParseDuration(route.Timeout); err != nil {
+				return nil, fmt.Errorf("%s: invalid timeout for %s: %w", path, route.Prefix, err)
+			}
+		}
+		if route.Cache != "" {
+			if route.cacheTTL, err = time.ParseDuration(route.Cache); err != nil {
+				return nil, fmt.Errorf("%s: invalid cache for %s: %w", path, route.Prefix, err)
+			}
+		}
+	}
+	return routes, nil
+}
+
+// serviceTransport sends requests to an instance of a discovered service
+// and reports the outcome to its load balancer.
+type serviceTransport struct {
+	c       *Config
+	service string
+	base    http.RoundTripper
+}
+
+func (t *serviceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	instance, err := t.c.pick(req.Context(), t.service)
+	if err != nil {
+		return nil, err
+	}
+	req.URL.Host = instance.addr
+	resp, err := t.base.RoundTrip(req)
+	instance.done(upstreamError(resp, err))
+	return resp, err
+}
+
+func (c *Config) proxyHandler(route proxyRoute) http.Handler {
+	target := route.target
+	var transport http.RoundTripper = http.DefaultTransport
+	if target == nil {
+		target = &url.URL{Scheme: "http", Host: route.Upstream}
+		transport = &serviceTransport{c: c, service: route.Upstream, base: http.DefaultTransport}
+	}
+
+	proxy := &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			path := req.URL.Path
+			if route.StripPrefix {
+				path = strings.TrimPrefix(path, route.Prefix)
+			}
+			req.URL.Scheme = target.Scheme
+			req.URL.Host = target.Host
+			req.URL.Path = singleJoiningSlash(target.Path, path)
+			req.URL.RawPath = ""
+			req.Host = target.Host
+			for _, name := range route.RemoveHeaders {
+				req.Header.Del(name)
+			}
+			for name, value := range route.SetHeaders {
+				req.Header.Set(name, value)
+			}
+		},
+		Transport: transport,
+		ModifyResponse: func(resp *http.Response) error {
+			for name, value := range route.ResponseHeaders {
+				resp.Header.Set(name, value)
+			}
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Printf("proxy %s: %v\n", route.Prefix, err)
+			status := http.StatusBadGateway
+			if errors.Is(err, context.DeadlineExceeded) {
+				status = http.StatusGatewayTimeout
+			}
+			c.ErrorJSON(w, errors.New("Upstream request failed"), status)
+		},
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), route.timeout)
+		defer cancel()
+		proxy.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func singleJoiningSlash(a, b string) string {
+	switch {
+	case b == "":
+		b = "/"
+	case !strings.HasPrefix(b, "/"):
+		b = "/" + b
+	}
+	return strings.TrimSuffix(a, "/") + b
+}
+
+// mountProxyRoutes registers the configured proxy routes on r.
+func (c *Config) mountProxyRoutes(r chi.Router) {
+	for _, route := range c.proxyRoutes {
+		var middlewares []func(http.Handler) http.Handler
+		if route.RateLimit > 0 {
+			middlewares = append(middlewares, c.rateLimit(newRateLimiter(route.RateLimit, route.Burst)))
+		}
+		if route.Auth {
+			middlewares = append(middlewares, c.requireToken)
+		}
+		if route.cacheTTL > 0 && c.cache != nil {
+			middlewares = append(middlewares, c.cacheResponses(route.cacheTTL))
+		}
+		handler := c.proxyHandler(route)
+		r.With(middlewares...).Handle(route.Prefix, handler)
+		r.With(middlewares...).Handle(route.Prefix+"/*", handler)
+	}
+}
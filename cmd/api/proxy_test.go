@@ -0,0 +1,35 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadProxyRoutesPrefix(t *testing.T) {
+	tests := []struct {
+		prefix  string
+		wantErr bool
+	}{
+		{"/services/mail", false},
+		{"/mailer/", false},
+		{"/mail", true},
+		{"/mail/", true},
+		{"/jobs/archive", true},
+		{"/admin", true},
+		{"/", true},
+		{"relative", true},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "proxy.json")
+		routes := `[{"prefix": "` + tt.prefix + `", "upstream": "http://upstream.test"}]`
+		if err := os.WriteFile(path, []byte(routes), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		t.Setenv("PROXY_ROUTES_FILE", path)
+		_, err := loadProxyRoutes(nil)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: got error %v, want error %v", tt.prefix, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	RABBITMQ_PORT            = "5672"
+	RABBITMQ_TLS_PORT        = "5671"
+	RABBITMQ_VHOST           = "/"
+	RABBITMQ_HEARTBEAT       = "10s"
+	RABBITMQ_CONNECTION_NAME = "broker"
+)
+
+// amqpConfig holds everything needed to dial RabbitMQ. It is built from
+// the environment by loadAMQPConfig.
+type amqpConfig struct {
+	scheme         string
+	host           string
+	port           string
+	username       string
+	password       string
+	vhost          string
+	caFile         string
+	certFile       string
+	keyFile        string
+	serverName     string
+	skipVerify     bool
+	heartbeat      time.Duration
+	frameSize      int
+	channelMax     int
+	connectionName string
+}
+
+// loadAMQPConfig reads the RabbitMQ settings from the environment.
+// RABBITMQ_URL may either be a bare host name or a full amqp:// or
+// amqps:// URL; values found in the URL take precedence over the
+// individual variables.
+func loadAMQPConfig() (*amqpConfig, error) {
+	cfg := &amqpConfig{
+		scheme:         "amqp",
+		host:           RABBITMQ_URL,
+		username:       getEnv("RABBITMQ_DEFAULT_USER", RABBITMQ_DEFAULT_USER),
+		password:       getEnv("RABBITMQ_DEFAULT_PASS", RABBITMQ_DEFAULT_PASS),
+		vhost:          getEnv("RABBITMQ_VHOST", RABBITMQ_VHOST),
+		caFile:         os.Getenv("RABBITMQ_CA_CERT"),
+		certFile:       os.Getenv("RABBITMQ_CLIENT_CERT"),
+		keyFile:        os.Getenv("RABBITMQ_CLIENT_KEY"),
+		serverName:     os.Getenv("RABBITMQ_SERVER_NAME"),
+		connectionName: getEnv("RABBITMQ_CONNECTION_NAME", RABBITMQ_CONNECTION_NAME),
+	}
+
+	var err error
+	if cfg.skipVerify, err = getEnvBool("RABBITMQ_TLS_SKIP_VERIFY", false); err != nil {
+		return nil, err
+	}
+	useTLS, err := getEnvBool("RABBITMQ_TLS", false)
+	if err != nil {
+		return nil, err
+	}
+	if useTLS || cfg.caFile != "" || cfg.certFile != "" {
+		cfg.scheme = "amqps"
+	}
+	if cfg.heartbeat, err = getEnvDuration("RABBITMQ_HEARTBEAT", RABBITMQ_HEARTBEAT); err != nil {
+		return nil, err
+	}
+	if cfg.frameSize, err = getEnvInt("RABBITMQ_FRAME_SIZE", 0); err != nil {
+		return nil, err
+	}
+	if cfg.channelMax, err = getEnvInt("RABBITMQ_CHANNEL_MAX", 0); err != nil {
+		return nil, err
+	}
+
+	rawURL := getEnv("RABBITMQ_URL", RABBITMQ_URL)
+	if strings.Contains(rawURL, "://") {
+		if err := cfg.applyURL(rawURL); err != nil {
+			return nil, err
+		}
+	} else {
+		cfg.host = rawURL
+	}
+
+	if cfg.port == "" {
+		cfg.port = RABBITMQ_PORT
+		if cfg.scheme == "amqps" {
+			cfg.port = RABBITMQ_TLS_PORT
+		}
+		cfg.port = getEnv("RABBITMQ_PORT", cfg.port)
+	}
+	if (cfg.certFile == "") != (cfg.keyFile == "") {
+		return nil, errors.New("RABBITMQ_CLIENT_CERT and RABBITMQ_CLIENT_KEY must be set together")
+	}
+	return cfg, nil
+}
+
+func (cfg *amqpConfig) applyURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid RABBITMQ_URL: %w", err)
+	}
+	switch u.Scheme {
+	case "amqp", "amqps":
+		cfg.scheme = u.Scheme
+	default:
+		return fmt.Errorf("invalid RABBITMQ_URL scheme %q", u.Scheme)
+	}
+	if u.Hostname() != "" {
+		cfg.host = u.Hostname()
+	}
+	cfg.port = u.Port()
+	if u.User != nil {
+		cfg.username = u.User.Username()
+		if password, ok := u.User.Password(); ok {
+			cfg.password = password
+		}
+	}
+	if len(u.Path) > 1 {
+		cfg.vhost = u.Path[1:]
+	}
+	return nil
+}
+
+// url returns the dial URL with the credentials and vhost escaped.
+func (cfg *amqpConfig) url() *url.URL {
+	return &url.URL{
+		Scheme:  cfg.scheme,
+		User:    url.UserPassword(cfg.username, cfg.password),
+		Host:    net.JoinHostPort(cfg.host, cfg.port),
+		Path:    "/" + cfg.vhost,
+		RawPath: "/" + url.PathEscape(cfg.vhost),
+	}
+}
+
+func (cfg *amqpConfig) tlsConfig() (*tls.Config, error) {
+	if cfg.scheme != "amqps" {
+		return nil, nil
+	}
+	tlsCfg := &tls.Config{
+		ServerName:         cfg.serverName,
+		InsecureSkipVerify: cfg.skipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+	if cfg.caFile != "" {
+		pem, err := os.ReadFile(cfg.caFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA bundle: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.caFile)
+		}
+		tlsCfg.RootCAs = pool
+	}
+	if cfg.certFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.certFile, cfg.keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %w", err)
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	}
+	return tlsCfg, nil
+}
+
+func (cfg *amqpConfig) dialConfig() (amqp.Config, error) {
+	tlsCfg, err := cfg.tlsConfig()
+	if err != nil {
+		return amqp.Config{}, err
+	}
+	props := amqp.NewConnectionProperties()
+	props.SetClientConnectionName(cfg.connectionName)
+	return amqp.Config{
+		Vhost:           cfg.vhost,
+		Heartbeat:       cfg.heartbeat,
+		FrameSize:       cfg.frameSize,
+		ChannelMax:      cfg.channelMax,
+		TLSClientConfig: tlsCfg,
+		Properties:      props,
+	}, nil
+}
+
+func (cfg *amqpConfig) dial() (*amqp.Connection, error) {
+	dialCfg, err := cfg.dialConfig()
+	if err != nil {
+		return nil, err
+	}
+	return amqp.DialConfig(cfg.url().String(), dialCfg)
+}
+
+// channel returns the publishing channel, reconnecting to RabbitMQ if the
+// connection or channel was closed.
+func (c *Config) channel() (*amqp.Channel, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ch != nil && !c.ch.IsClosed() {
+		return c.ch, nil
+	}
+	if c.conn == nil || c.conn.IsClosed() {
+		conn, err := c.amqp.dial()
+		if err != nil {
+			return nil, err
+		}
+		log.Println("Reconnected to Rabbit")
+		c.conn = conn
+		if c.jobs != nil {
+			if err := c.consumeReplies(); err != nil {
+				log.Println("failed to consume job replies:", err)
+			}
+		}
+	}
+	ch, err := declareChannel(c.conn)
+	if err != nil {
+		return nil, err
+	}
+	c.ch = ch
+	return ch, nil
+}
+
+// publishBatch sends the records of entries and then waits for their
+// confirms, returning how many of them, from the start, were confirmed.
+func (c *Config) publishBatch(ctx context.Context, entries []outboxEntry) (int, error) {
+	ch, err := c.channel()
+	if err != nil {
+		return 0, err
+	}
+	confirms := make([]*amqp.DeferredConfirmation, 0, len(entries))
+	var publishErr error
+	for _, entry := range entries {
+		rec := entry.record
+		confirm, err := ch.PublishWithDeferredConfirmWithContext(ctx, rec.Exchange, rec.RoutingKey, false, false, rec.Msg)
+		if err != nil {
+			publishErr = err
+			break
+		}
+		confirms = append(confirms, confirm)
+	}
+	for i, confirm := range confirms {
+		acked, err := confirm.WaitContext(ctx)
+		if err != nil {
+			return i, err
+		}
+		if !acked {
+			return i, errors.New("message was not acknowledged by rabbit")
+		}
+	}
+	return len(confirms), publishErr
+}
+
+// publish sends msg and waits for the broker to confirm it.
+func (c *Config) publish(ctx context.Context, exchange, key string, msg amqp.Publishing) error {
+	ch, err := c.channel()
+	if err != nil {
+		return err
+	}
+	confirm, err := ch.PublishWithDeferredConfirmWithContext(ctx,
+		exchange, // exchange
+		key,      // routing key
+		false,    // mandatory
+		false,    // immediate
+		msg)
+	if err != nil {
+		return err
+	}
+	acked, err := confirm.WaitContext(ctx)
+	if err != nil {
+		return err
+	}
+	if !acked {
+		return errors.New("message was not acknowledged by rabbit")
+	}
+	return nil
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	MAIL_MAX_RECIPIENTS = 50
+	MAIL_SEND_AT_MAX    = "720h"
+)
+
+// reservedMailHeaders are set by the mail service from the request
+// fields and can't be overridden with custom headers.
+var reservedMailHeaders = map[string]bool{
+	"From":                      true,
+	"To":                        true,
+	"Cc":                        true,
+	"Bcc":                       true,
+	"Reply-To":                  true,
+	"Subject":                   true,
+	"Date":                      true,
+	"Message-Id":                true,
+	"Mime-Version":              true,
+	"Content-Type":              true,
+	"Content-Transfer-Encoding": true,
+}
+
+// scheduleSteps are the delays a scheduled send waits in before the
+// worker looks at it again. Every step is its own delay queue, so the
+// messages in one queue always expire in order.
+var scheduleSteps = []time.Duration{
+	24 * time.Hour,
+	6 * time.Hour,
+	time.Hour,
+	10 * time.Minute,
+	time.Minute,
+	10 * time.Second,
+	time.Second,
+}
+
+// addressList is a list of email addresses, which may also be given as
+// a single string.
+type addressList []string
+
+func (l *addressList) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*l = nil
+		if single != "" {
+			*l = addressList{single}
+		}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return errors.New("addresses must be a string or a list of strings")
+	}
+	*l = list
+	return nil
+}
+
+type recipientLimits struct {
+	maxRecipients int
+	maxSendAt     time.Duration
+}
+
+func loadRecipientLimits() (*recipientLimits, error) {
+	maxRecipients, err := getEnvInt("MAIL_MAX_RECIPIENTS", MAIL_MAX_RECIPIENTS)
+	if err != nil {
+		return nil, err
+	}
+	maxSendAt, err := getEnvDuration("MAIL_SEND_AT_MAX", MAIL_SEND_AT_MAX)
+	if err != nil {
+		return nil, err
+	}
+	return &recipientLimits{maxRecipients: maxRecipients, maxSendAt: maxSendAt}, nil
+}
+
+// scheduled reports whether the email should be sent later.
+func (s sendType) scheduled() bool {
+	return s.SendAt != nil && time.Until(*s.SendAt) > 0
+}
+
+// validateSend checks the addresses, recipients, headers, files and
+// schedule of an email before it is sent or queued.
+func (c *Config) validateSend(request sendType) error {
+	total := len(request.To) + len(request.CC) + len(request.BCC)
+	if total == 0 {
+		return errors.New("The email has no recipients")
+	}
+	if total > c.recipients.maxRecipients {
+		return fmt.Errorf("The email has more than %d recipients", c.recipients.maxRecipients)
+	}
+	for _, list := range []addressList{request.To, request.CC, request.BCC} {
+		for _, address := range list {
+			if _, err := mail.ParseAddress(address); err != nil {
+				return fmt.Errorf("Invalid recipient %q", address)
+			}
+		}
+	}
+	if request.From != "" {
+		if _, err := mail.ParseAddress(request.From); err != nil {
+			return fmt.Errorf("Invalid sender %q", request.From)
+		}
+	}
+	if request.ReplyTo != "" {
+		if _, err := mail.ParseAddress(request.ReplyTo); err != nil {
+			return fmt.Errorf("Invalid reply-to address %q", request.ReplyTo)
+		}
+	}
+	for name, value := range request.Headers {
+		if !validHeaderName(name) {
+			return fmt.Errorf("Invalid header name %q", name)
+		}
+		if reservedMailHeaders[textproto.CanonicalMIMEHeaderKey(name)] {
+			return fmt.Errorf("Header %s can't be set", name)
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return fmt.Errorf("Header %s has an invalid value", name)
+		}
+	}
+	if err := c.checkFiles(request.Files); err != nil {
+		return err
+	}
+	if request.SendAt != nil && time.Until(*request.SendAt) > c.recipients.maxSendAt {
+		return fmt.Errorf("send_at can't be more than %s ahead", c.recipients.maxSendAt)
+	}
+	// stored files must still be in the store when the email is sent
+	for _, file := range request.Files {
+		if request.SendAt == nil || file.URL == "" {
+			continue
+		}
+		if expires, err := c.attachments.expires(file); err == nil && request.SendAt.After(expires) {
+			return fmt.Errorf("Attachment %s expires before send_at", file.Filename)
+		}
+	}
+	return nil
+}
+
+// validHeaderName reports whether name is a valid RFC 5322 field name.
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if r <= ' ' || r > '~' || r == ':' {
+			return false
+		}
+	}
+	return true
+}
+
+// scheduleEmail queues request for the worker, which holds it in the
+// delay queues until its send_at.
+func (c *Config) scheduleEmail(request sendType) (jsonResponse, error) {
+	if c.outbox == nil {
+		return jsonResponse{}, errors.New("Scheduling Email error")
+	}
+	j, err := c.queueRequest(requestType{Action: Send, Send: request})
+	if err != nil {
+		return jsonResponse{}, err
+	}
+	var payload jsonResponse
+	payload.Error = false
+	payload.Message = "Email Scheduled"
+	payload.Data = j
+	return payload, nil
+}
+
+// scheduleDelay returns the longest step that doesn't overshoot
+// remaining.
+func scheduleDelay(remaining time.Duration) time.Duration {
+	for _, step := range scheduleSteps {
+		if step <= remaining {
+			return step
+		}
+	}
+	return scheduleSteps[len(scheduleSteps)-1]
+}
+
+// schedule holds msg in a delay queue until it is due. It comes back
+// to the broker queue and is looked at again after the delay.
+func (w *worker) schedule(msg amqp.Delivery, sendAt time.Time) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	queue, err := w.retrier.delayQueue(scheduleDelay(time.Until(sendAt)))
+	if err == nil {
+		err = w.c.publish(ctx, "", queue, publishingFromDelivery(msg))
+	}
+	if err != nil {
+		log.Println("worker: failed to schedule email:", err)
+		msg.Nack(false, true)
+		return
+	}
+	msg.Ack(false)
+}
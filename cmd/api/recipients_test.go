@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSendTypeJSON(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want sendType
+	}{
+		{"single recipient", `{"from":"a@example.com","from_name":"A","to":"b@example.com","subject":"s","attachments":["x"]}`,
+			sendType{From: "a@example.com", FromName: "A", To: addressList{"b@example.com"}, Subject: "s", Attachment: []string{"x"}}},
+		{"lists", `{"to":["b@example.com","c@example.com"],"cc":"d@example.com","bcc":[]}`,
+			sendType{To: addressList{"b@example.com", "c@example.com"}, CC: addressList{"d@example.com"}, BCC: addressList{}}},
+		{"empty string", `{"to":""}`, sendType{}},
+	}
+	for _, tt := range tests {
+		var got sendType
+		if err := json.Unmarshal([]byte(tt.in), &got); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+
+	var invalid sendType
+	if err := json.Unmarshal([]byte(`{"to":1}`), &invalid); err == nil {
+		t.Error("a number was taken as an address")
+	}
+
+	// the mail service gets lowercase keys and to as a list
+	out, err := json.Marshal(sendType{From: "a@example.com", To: addressList{"b@example.com"}, Subject: "s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"from":"a@example.com","to":["b@example.com"],"subject":"s","body":""}`
+	if string(out) != want {
+		t.Errorf("got %s, want %s", out, want)
+	}
+}
+
+func TestValidateSendAt(t *testing.T) {
+	limits := testAttachmentLimits(t, "store")
+	if err := os.WriteFile(filepath.Join(limits.dir, "stored"), []byte("stored text"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	c := &Config{attachments: limits, recipients: &recipientLimits{maxRecipients: 10, maxSendAt: 48 * time.Hour}}
+	stored := attachmentType{Filename: "a.txt", ContentType: "text/plain", Size: 11, URL: "http://broker.test/attachments/stored"}
+	inline := attachmentType{Filename: "a.txt", ContentType: "text/plain", Size: 11, Data: base64.StdEncoding.EncodeToString([]byte("inline text"))}
+	at := func(d time.Duration) *time.Time {
+		when := time.Now().Add(d)
+		return &when
+	}
+	tests := []struct {
+		name    string
+		sendAt  *time.Time
+		files   []attachmentType
+		wantErr bool
+	}{
+		{"now", nil, []attachmentType{stored}, false},
+		{"within the limit", at(24 * time.Hour), nil, false},
+		{"past the limit", at(72 * time.Hour), nil, true},
+		{"before the file expires", at(limits.ttl / 2), []attachmentType{stored}, false},
+		{"after the file expires", at(2 * limits.ttl), []attachmentType{stored}, true},
+		{"inline file", at(2 * limits.ttl), []attachmentType{inline}, false},
+	}
+	for _, tt := range tests {
+		request := sendType{To: addressList{"to@example.com"}, SendAt: tt.sendAt, Files: tt.files}
+		if err := c.validateSend(request); (err != nil) != tt.wantErr {
+			t.Errorf("%s: err = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const REDACTION_FILE = "redaction.json"
+
+// stages the redaction rules apply to
+const (
+	stageLog   = "log"
+	stageQueue = "queue"
+	stageTrace = "trace"
+)
+
+const redacted = "[REDACTED]"
+
+// logRedactedHeader marks queued logging messages whose log already had
+// the log rules applied.
+const logRedactedHeader = "x-log-redacted"
+
+// redactionConfig is the content of REDACTION_FILE. Field rules match
+// dotted paths into the JSON of a request, where * stands for one key
+// and ** for any number of them. Detectors replace matches of a regular
+// expression in every string.
+type redactionConfig struct {
+	Fields    []fieldRule    `json:"fields"`
+	Detectors []detectorRule `json:"detectors"`
+}
+
+type fieldRule struct {
+	Path   string   `json:"path"`
+	Action string   `json:"action"`
+	Stages []string `json:"stages"`
+
+	segments []string
+}
+
+type detectorRule struct {
+	Name        string   `json:"name"`
+	Pattern     string   `json:"pattern"`
+	Replacement string   `json:"replacement"`
+	Stages      []string `json:"stages"`
+
+	re *regexp.Regexp
+}
+
+// defaultRedaction is used without a REDACTION_FILE. It leaves queued
+// messages alone, as the worker needs the password of an authentication
+// and the addresses of an email.
+var defaultRedaction = redactionConfig{
+	Fields: []fieldRule{
+		{Path: "**.password", Stages: []string{stageLog, stageTrace}},
+		{Path: "**.token", Stages: []string{stageLog, stageTrace}},
+		{Path: "**.secret", Stages: []string{stageLog, stageTrace}},
+		{Path: "**.authorization", Stages: []string{stageLog, stageTrace}},
+	},
+	Detectors: []detectorRule{
+		{Name: "email", Pattern: `[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`, Replacement: "[EMAIL]", Stages: []string{stageLog, stageTrace}},
+		{Name: "jwt", Pattern: `eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`, Replacement: "[TOKEN]", Stages: []string{stageLog, stageTrace}},
+		{Name: "bearer", Pattern: `(?i)bearer\s+[A-Za-z0-9._~+/-]+=*`, Replacement: "Bearer [TOKEN]", Stages: []string{stageLog, stageTrace}},
+	},
+}
+
+// redactor holds the field rules and detectors of each stage.
+type redactor struct {
+	fields    map[string][]fieldRule
+	detectors map[string][]detectorRule
+}
+
+func loadRedactor() (*redactor, error) {
+	cfg := defaultRedaction
+	path := getEnv("REDACTION_FILE", REDACTION_FILE)
+	data, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return nil, err
+	default:
+		cfg = redactionConfig{}
+		if err := json.Unmarshal(data, &cfg); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	r := &redactor{fields: make(map[string][]fieldRule), detectors: make(map[string][]detectorRule)}
+	stages := func(given []string) ([]string, error) {
+		if len(given) == 0 {
+			return []string{stageLog, stageQueue, stageTrace}, nil
+		}
+		for _, stage := range given {
+			if stage != stageLog && stage != stageQueue && stage != stageTrace {
+				return nil, fmt.Errorf("invalid stage %q, expected log, queue or trace", stage)
+			}
+		}
+		return given, nil
+	}
+	for _, rule := range cfg.Fields {
+		switch rule.Action {
+		case "":
+			rule.Action = "redact"
+		case "redact", "remove", "hash":
+		default:
+			return nil, fmt.Errorf("field %s: invalid action %q, expected redact, remove or hash", rule.Path, rule.Action)
+		}
+		if rule.Path == "" {
+			return nil, errors.New("field rule without a path")
+		}
+		rule.segments = strings.Split(strings.ToLower(rule.Path), ".")
+		ruleStages, err := stages(rule.Stages)
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %w", rule.Path, err)
+		}
+		for _, stage := range ruleStages {
+			r.fields[stage] = append(r.fields[stage], rule)
+		}
+	}
+	for _, detector := range cfg.Detectors {
+		if detector.re, err = regexp.Compile(detector.Pattern); err != nil {
+			return nil, fmt.Errorf("detector %s: %w", detector.Name, err)
+		}
+		if detector.Replacement == "" {
+			detector.Replacement = redacted
+		}
+		detectorStages, err := stages(detector.Stages)
+		if err != nil {
+			return nil, fmt.Errorf("detector %s: %w", detector.Name, err)
+		}
+		for _, stage := range detectorStages {
+			r.detectors[stage] = append(r.detectors[stage], detector)
+		}
+	}
+	return r, nil
+}
+
+func (r *redactor) active(stage string) bool {
+	return len(r.fields[stage]) > 0 || len(r.detectors[stage]) > 0
+}
+
+// redactJSON applies the rules of stage to a JSON document. Anything
+// that isn't valid JSON only goes through the detectors.
+func (r *redactor) redactJSON(stage string, data []byte) []byte {
+	if !r.active(stage) {
+		return data
+	}
+	var v any
+	if err := json.Unmarshal(data, &v); err != nil {
+		return []byte(r.redactString(stage, string(data)))
+	}
+	out, err := json.Marshal(r.walk(stage, v, nil))
+	if err != nil {
+		return []byte(redacted)
+	}
+	return out
+}
+
+func (r *redactor) redactString(stage, s string) string {
+	for _, detector := range r.detectors[stage] {
+		s = detector.re.ReplaceAllString(s, detector.Replacement)
+	}
+	return s
+}
+
+func (r *redactor) walk(stage string, v any, path []string) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for key, value := range v {
+			keyPath := append(path[:len(path):len(path)], strings.ToLower(key))
+			rule, ok := r.rule(stage, keyPath)
+			if !ok {
+				v[key] = r.walk(stage, value, keyPath)
+				continue
+			}
+			switch rule.Action {
+			case "remove":
+				delete(v, key)
+			case "hash":
+				v[key] = hashValue(value)
+			default:
+				v[key] = redactValue(value)
+			}
+		}
+		return v
+	case []any:
+		for i, value := range v {
+			v[i] = r.walk(stage, value, path)
+		}
+		return v
+	case string:
+		return r.redactString(stage, v)
+	}
+	return v
+}
+
+func (r *redactor) rule(stage string, path []string) (fieldRule, bool) {
+	for _, rule := range r.fields[stage] {
+		if matchPath(rule.segments, path) {
+			return rule, true
+		}
+	}
+	return fieldRule{}, false
+}
+
+// matchPath matches path against pattern, in which * is one segment and
+// ** any number of them.
+func matchPath(pattern, path []string) bool {
+	if len(pattern) == 0 {
+		return len(path) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(path); i++ {
+			if matchPath(pattern[1:], path[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(path) == 0 || (pattern[0] != "*" && pattern[0] != path[0]) {
+		return false
+	}
+	return matchPath(pattern[1:], path[1:])
+}
+
+// redactValue replaces a string by the redaction marker. Other values
+// become null, so the document still fits the type it is decoded into.
+func redactValue(v any) any {
+	if _, ok := v.(string); ok {
+		return redacted
+	}
+	return nil
+}
+
+// hashValue replaces a string by a short hash of it, which still tells
+// equal values apart.
+func hashValue(v any) any {
+	s, ok := v.(string)
+	if !ok {
+		return nil
+	}
+	sum := sha256.Sum256([]byte(s))
+	return "sha256:" + hex.EncodeToString(sum[:8])
+}
+
+// redactAs applies the rules of stage to v through its JSON. If the
+// result no longer decodes, the zero value is returned rather than the
+// unredacted one.
+func redactAs[T any](r *redactor, stage string, v T) T {
+	if !r.active(stage) {
+		return v
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		var zero T
+		return zero
+	}
+	var out T
+	if err := json.Unmarshal(r.redactJSON(stage, data), &out); err != nil {
+		log.Println("redaction:", err)
+		var zero T
+		return zero
+	}
+	return out
+}
+
+// redactRequest prepares request for the queue. The log of a logging
+// action gets the log rules here already, and the message is marked
+// with logRedactedHeader so the worker doesn't apply them a second time.
+func (c *Config) redactRequest(request requestType) requestType {
+	if request.Action == Logging {
+		request.Log = redactAs(c.redactor, stageLog, request.Log)
+	}
+	return c.trimRequest(request)
+}
+
+// trimRequest keeps only the part of the action and applies the queue
+// rules to the whole request.
+func (c *Config) trimRequest(request requestType) requestType {
+	trimmed := requestType{Action: request.Action}
+	switch request.Action {
+	case Authorization:
+		trimmed.Auth = request.Auth
+	case Logging:
+		trimmed.Log = request.Log
+	case Send:
+		trimmed.Send = request.Send
+	default:
+		return redactAs(c.redactor, stageQueue, request)
+	}
+	return redactAs(c.redactor, stageQueue, trimmed)
+}
+
+// markLogRedacted records on a queued logging message that its log had
+// the log rules applied.
+func markLogRedacted(msg *amqp.Publishing, action string) {
+	if action != Logging {
+		return
+	}
+	if msg.Headers == nil {
+		msg.Headers = amqp.Table{}
+	}
+	msg.Headers[logRedactedHeader] = true
+}
+
+type logRedactedKey struct{}
+
+// withLogRedacted tells handleLogging that the log rules were applied
+// before the log reached it.
+func withLogRedacted(ctx context.Context) context.Context {
+	return context.WithValue(ctx, logRedactedKey{}, true)
+}
+
+func logRedacted(ctx context.Context) bool {
+	redacted, _ := ctx.Value(logRedactedKey{}).(bool)
+	return redacted
+}
+
+// redactDeadLetter applies the trace rules to the payload shown by the
+// admin API. Requests in a binary encoding are shown as JSON.
+func (c *Config) redactDeadLetter(dl *deadLetter, msg amqp.Delivery) {
+	if dl.Payload == nil || !c.redactor.active(stageTrace) {
+		return
+	}
+	body := msg.Body
+	if !json.Valid(body) {
+		if request, err := decodeRequest(msg); err == nil {
+			body, _ = json.Marshal(request)
+		}
+	}
+	body = c.redactor.redactJSON(stageTrace, body)
+	payload := string(body)
+	dl.Payload = &payload
+	dl.JSON = nil
+	if json.Valid(body) {
+		dl.JSON = body
+	}
+}
+
+// redactRequestURI hides the query values matching the trace rules, as
+// query.<name>, from the request log.
+func (c *Config) redactRequestURI(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.RawQuery != "" && c.redactor.active(stageTrace) {
+			query := r.URL.Query()
+			for name, values := range query {
+				path := []string{"query", strings.ToLower(name)}
+				for i, value := range values {
+					if rule, ok := c.redactor.rule(stageTrace, path); ok && rule.Action == "hash" {
+						values[i] = hashValue(value).(string)
+					} else if ok {
+						values[i] = redacted
+					} else {
+						values[i] = c.redactor.redactString(stageTrace, value)
+					}
+				}
+			}
+			// only the logger reads RequestURI, routing uses r.URL
+			r.RequestURI = r.URL.EscapedPath() + "?" + (url.Values(query)).Encode()
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const testRedactionRules = `{
+  "fields": [
+    {"path": "**.password", "stages": ["log", "queue"]},
+    {"path": "log.fields.user", "action": "hash", "stages": ["log"]},
+    {"path": "fields.user", "action": "hash", "stages": ["log"]},
+    {"path": "**.internal", "action": "remove"}
+  ],
+  "detectors": [
+    {"name": "email", "pattern": "[a-z]+@example\\.com", "replacement": "[EMAIL]", "stages": ["log", "trace"]}
+  ]
+}`
+
+func newTestRedactor(t *testing.T, rules string) *redactor {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "redaction.json")
+	if err := os.WriteFile(path, []byte(rules), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("REDACTION_FILE", path)
+	r, err := loadRedactor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestRedactJSON(t *testing.T) {
+	r := newTestRedactor(t, testRedactionRules)
+	tests := []struct {
+		stage string
+		in    string
+		want  string
+	}{
+		{stageLog, `{"auth":{"Password":"p"}}`, `{"auth":{"Password":"[REDACTED]"}}`},
+		{stageLog, `{"fields":{"user":"ann"}}`, `{"fields":{"user":"sha256:` + hashValue("ann").(string)[7:] + `"}}`},
+		{stageLog, `{"n":1,"internal":{"a":1}}`, `{"n":1}`},
+		{stageLog, `{"message":"mail ann@example.com"}`, `{"message":"mail [EMAIL]"}`},
+		{stageQueue, `{"message":"mail ann@example.com","password":1}`, `{"message":"mail ann@example.com","password":null}`},
+		{stageTrace, `not json ann@example.com`, `not json [EMAIL]`},
+	}
+	for _, tt := range tests {
+		if got := string(r.redactJSON(tt.stage, []byte(tt.in))); got != tt.want {
+			t.Errorf("%s %s: got %s, want %s", tt.stage, tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestMatchPath(t *testing.T) {
+	tests := []struct {
+		pattern, path string
+		want          bool
+	}{
+		{"a.b", "a.b", true},
+		{"a.*", "a.b", true},
+		{"a.*", "a.b.c", false},
+		{"**.b", "b", true},
+		{"**.b", "x.y.b", true},
+		{"a.**", "a", true},
+		{"a.**.c", "a.x.y.c", true},
+		{"a.b", "a", false},
+	}
+	for _, tt := range tests {
+		if got := matchPath(strings.Split(tt.pattern, "."), strings.Split(tt.path, ".")); got != tt.want {
+			t.Errorf("%s against %s: got %v", tt.pattern, tt.path, got)
+		}
+	}
+}
+
+func TestRedactRequestTrims(t *testing.T) {
+	c := &Config{redactor: newTestRedactor(t, testRedactionRules)}
+	auth := authType{Email: "a@example.com", Password: "p"}
+	tests := []struct {
+		name     string
+		in       requestType
+		wantAuth authType
+		wantLog  logType
+		wantSend string
+	}{
+		{"auth keeps only auth, queue rules", requestType{Action: Authorization, Auth: auth, Log: logType{Name: "x"}, Send: sendType{Subject: "s"}},
+			authType{Email: "a@example.com", Password: redacted}, logType{}, ""},
+		{"send drops auth", requestType{Action: Send, Auth: auth, Send: sendType{Subject: "s"}},
+			authType{Password: redacted}, logType{}, "s"},
+		{"log gets the log rules", requestType{Action: Logging, Auth: auth, Log: logType{Message: "by ann@example.com"}},
+			authType{Password: redacted}, logType{Message: "by [EMAIL]"}, ""},
+	}
+	for _, tt := range tests {
+		got := c.redactRequest(tt.in)
+		if got.Action != tt.in.Action || got.Auth != tt.wantAuth || !reflect.DeepEqual(got.Log, tt.wantLog) || got.Send.Subject != tt.wantSend {
+			t.Errorf("%s: got %+v", tt.name, got)
+		}
+	}
+}
+
+// TestLogRulesApplyOnce queues a log, hashing a field, and hands it to
+// the logging transport the way the worker does.
+func TestLogRulesApplyOnce(t *testing.T) {
+	metrics := newMetricsRegistry()
+	policy, err := loadLogPolicy(metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buffer := &logBuffer{size: 100, max: 100, wake: make(chan struct{}, 1)}
+	c := &Config{
+		redactor:      newTestRedactor(t, testRedactionRules),
+		logPolicy:     policy,
+		logTransports: []string{logViaHTTP},
+		logBuffer:     buffer,
+	}
+	hashed := hashValue("ann")
+
+	request := c.redactRequest(requestType{Action: Logging, Log: logType{Name: "n", Level: "error", Fields: map[string]any{"user": "ann"}}})
+	msg, err := newEnvelope(codecs[0], "id", request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	markLogRedacted(&msg, Logging)
+	if msg.Headers[logRedactedHeader] != true {
+		t.Fatalf("message not marked: %v", msg.Headers)
+	}
+	queued, err := decodeRequest(amqp.Delivery{ContentType: msg.ContentType, Headers: msg.Headers, Body: msg.Body})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		ctx  context.Context
+		log  logType
+		want any
+	}{
+		{"queued log", withLogRedacted(context.Background()), queued.Log, hashed},
+		{"log from /handle", context.Background(), logType{Name: "n", Level: "error", Fields: map[string]any{"user": "ann"}}, hashed},
+	}
+	for _, tt := range tests {
+		buffer.entries = nil
+		if _, err := c.handleLogging(tt.ctx, tt.log); err != nil {
+			t.Fatal(err)
+		}
+		if len(buffer.entries) != 1 || buffer.entries[0].Fields["user"] != tt.want {
+			t.Errorf("%s: got %+v, want user %v", tt.name, buffer.entries, tt.want)
+		}
+	}
+}
+
+func TestCloudEventIsTrimmed(t *testing.T) {
+	t.Setenv("OUTBOX_DIR", t.TempDir())
+	outbox, err := openOutbox()
+	if err != nil {
+		t.Fatal(err)
+	}
+	jobs, err := newJobStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Config{redactor: newTestRedactor(t, `{}`), outbox: outbox, jobs: jobs, queue: queneName, recipients: &recipientLimits{maxRecipients: 10}}
+
+	body := `{"specversion":"1.0","id":"1","source":"test","type":"broker.send","datacontenttype":"application/json",` +
+		`"data":{"auth":{"email":"a@example.com","password":"p"},"send":{"to":"b@example.com","subject":"s"}}}`
+	r := httptest.NewRequest(http.MethodPost, "/events", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/cloudevents+json")
+	w := httptest.NewRecorder()
+	c.handleCloudEvent(w, r)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("got %d: %s", w.Code, w.Body.String())
+	}
+	entries, err := outbox.read(1)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("outbox: %v, %v", entries, err)
+	}
+	data := string(entries[0].record.Msg.Body)
+	if strings.Contains(data, "a@example.com") || strings.Contains(data, `"p"`) {
+		t.Errorf("event data not trimmed to the action: %s", data)
+	}
+}
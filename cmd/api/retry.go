@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	RETRY_MAX_ATTEMPTS = 3
+	RETRY_BACKOFF      = "1s"
+	RETRY_MAX_BACKOFF  = "5m"
+)
+
+const (
+	parkingQueueName = "broker.parking"
+	retryQueueSuffix = ".retry."
+)
+
+// headers carried by retried and parked messages
+const (
+	retryCountHeader         = "x-retry-count"
+	lastErrorHeader          = "x-last-error"
+	originalRoutingKeyHeader = "x-original-routing-key"
+	parkedAtHeader           = "x-parked-at"
+)
+
+// retryPolicy decides how often and when a failed action is retried.
+type retryPolicy struct {
+	maxAttempts int
+	backoff     time.Duration
+	maxBackoff  time.Duration
+}
+
+// delay returns the exponential backoff before the given retry, 1 being
+// the first one.
+func (p retryPolicy) delay(retry int) time.Duration {
+	d := p.backoff
+	for i := 1; i < retry && d < p.maxBackoff; i++ {
+		d *= 2
+	}
+	if d > p.maxBackoff {
+		d = p.maxBackoff
+	}
+	return d
+}
+
+// loadRetryPolicies reads the default policy from RETRY_MAX_ATTEMPTS,
+// RETRY_BACKOFF and RETRY_MAX_BACKOFF, and per action overrides such as
+// RETRY_SEND_MAX_ATTEMPTS.
+func loadRetryPolicies() (map[string]retryPolicy, error) {
+	load := func(prefix string, def retryPolicy) (retryPolicy, error) {
+		p := def
+		var err error
+		if p.maxAttempts, err = getEnvInt(prefix+"_MAX_ATTEMPTS", def.maxAttempts); err != nil {
+			return p, err
+		}
+		if p.backoff, err = getEnvDuration(prefix+"_BACKOFF", def.backoff.String()); err != nil {
+			return p, err
+		}
+		if p.maxBackoff, err = getEnvDuration(prefix+"_MAX_BACKOFF", def.maxBackoff.String()); err != nil {
+			return p, err
+		}
+		return p, nil
+	}
+
+	backoff, _ := time.ParseDuration(RETRY_BACKOFF)
+	maxBackoff, _ := time.ParseDuration(RETRY_MAX_BACKOFF)
+	def, err := load("RETRY", retryPolicy{maxAttempts: RETRY_MAX_ATTEMPTS, backoff: backoff, maxBackoff: maxBackoff})
+	if err != nil {
+		return nil, err
+	}
+	policies := map[string]retryPolicy{"": def}
+	for _, action := range []string{Authorization, Logging, Send} {
+		if policies[action], err = load("RETRY_"+strings.ToUpper(action), def); err != nil {
+			return nil, err
+		}
+	}
+	return policies, nil
+}
+
+// retrier moves failed messages to a delay queue per backoff step, from
+// which they are dead-lettered back to their original queue once the
+// queue TTL expires, or to the parking lot when they run out of
+// attempts.
+type retrier struct {
+	c        *Config
+	policies map[string]retryPolicy
+
+	mu       sync.Mutex
+	declared map[time.Duration]bool
+}
+
+func newRetrier(c *Config) (*retrier, error) {
+	policies, err := loadRetryPolicies()
+	if err != nil {
+		return nil, err
+	}
+	return &retrier{c: c, policies: policies, declared: make(map[time.Duration]bool)}, nil
+}
+
+func (r *retrier) policy(action string) retryPolicy {
+	if p, ok := r.policies[action]; ok {
+		return p
+	}
+	return r.policies[""]
+}
+
+// retry schedules msg for another attempt. It returns false without
+// doing anything when the policy has no attempts left.
+func (r *retrier) retry(ctx context.Context, msg amqp.Delivery, action string, cause error) (bool, error) {
+	policy := r.policy(action)
+	retries := headerInt(msg.Headers, retryCountHeader) + 1
+	if retries >= policy.maxAttempts {
+		return false, nil
+	}
+	delay := policy.delay(retries)
+	queue, err := r.delayQueue(delay)
+	if err != nil {
+		return false, err
+	}
+	out := publishingFromDelivery(msg)
+	out.Headers[retryCountHeader] = int32(retries)
+	out.Headers[lastErrorHeader] = cause.Error()
+	if err := r.c.publish(ctx, "", queue, out); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// park moves msg to the parking lot queue for inspection.
+func (r *retrier) park(ctx context.Context, msg amqp.Delivery, cause error) error {
+	out := publishingFromDelivery(msg)
+	out.Headers[lastErrorHeader] = cause.Error()
+	out.Headers[parkedAtHeader] = time.Now().UTC().Format(time.RFC3339)
+	return r.c.publish(ctx, "", parkingQueueName, out)
+}
+
+// delayQueue declares the queue holding messages for delay.
+func (r *retrier) delayQueue(delay time.Duration) (string, error) {
+	name := r.c.queue + retryQueueSuffix + strconv.FormatInt(delay.Milliseconds(), 10)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.declared[delay] {
+		return name, nil
+	}
+	ch, err := r.c.channel()
+	if err != nil {
+		return "", err
+	}
+	_, err = ch.QueueDeclare(
+		name,  // name
+		true,  // durable
+		false, // delete when unused
+		false, // exclusive
+		false, // no-wait
+		amqp.Table{
+			"x-message-ttl":             delay.Milliseconds(),
+			"x-dead-letter-exchange":    "",
+			"x-dead-letter-routing-key": r.c.queue,
+		},
+	)
+	if err != nil {
+		return "", err
+	}
+	r.declared[delay] = true
+	return name, nil
+}
+
+func declareParkingQueue(ch *amqp.Channel) error {
+	_, err := ch.QueueDeclare(
+		parkingQueueName, // name
+		true,             // durable
+		false,            // delete when unused
+		false,            // exclusive
+		false,            // no-wait
+		nil,              // arguments
+	)
+	return err
+}
+
+// publishingFromDelivery copies msg so it can be published again,
+// keeping track of the queue it was originally sent to.
+func publishingFromDelivery(msg amqp.Delivery) amqp.Publishing {
+	headers := amqp.Table{}
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+	if _, ok := headers[originalRoutingKeyHeader]; !ok {
+		headers[originalRoutingKeyHeader] = msg.RoutingKey
+	}
+	return amqp.Publishing{
+		Headers:         headers,
+		ContentType:     msg.ContentType,
+		ContentEncoding: msg.ContentEncoding,
+		DeliveryMode:    msg.DeliveryMode,
+		Priority:        msg.Priority,
+		CorrelationId:   msg.CorrelationId,
+		ReplyTo:         msg.ReplyTo,
+		MessageId:       msg.MessageId,
+		Timestamp:       msg.Timestamp,
+		Type:            msg.Type,
+		UserId:          msg.UserId,
+		AppId:           msg.AppId,
+		Body:            msg.Body,
+	}
+}
+
+// headerInt reads an integer header, which may arrive as any of the
+// AMQP integer types.
+func headerInt(headers amqp.Table, key string) int {
+	switch v := headers[key].(type) {
+	case int:
+		return v
+	case int8:
+		return int(v)
+	case int16:
+		return int(v)
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	case uint8:
+		return int(v)
+	case uint16:
+		return int(v)
+	case uint32:
+		return int(v)
+	case float64:
+		return int(v)
+	case string:
+		i, _ := strconv.Atoi(v)
+		return i
+	}
+	return 0
+}
+
+func (p retryPolicy) String() string {
+	return fmt.Sprintf("max attempts %d, backoff %s up to %s", p.maxAttempts, p.backoff, p.maxBackoff)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestRetryDelay(t *testing.T) {
+	p := retryPolicy{maxAttempts: 10, backoff: time.Second, maxBackoff: 5 * time.Second}
+	tests := []struct {
+		retry int
+		want  time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 5 * time.Second},
+		{60, 5 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := p.delay(tt.retry); got != tt.want {
+			t.Errorf("retry %d: got %s, want %s", tt.retry, got, tt.want)
+		}
+	}
+}
+
+func TestLoadRetryPolicies(t *testing.T) {
+	t.Setenv("RETRY_MAX_ATTEMPTS", "5")
+	t.Setenv("RETRY_SEND_MAX_ATTEMPTS", "8")
+	t.Setenv("RETRY_SEND_BACKOFF", "10s")
+	r, err := newRetrier(&Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		action string
+		want   retryPolicy
+	}{
+		{"", retryPolicy{maxAttempts: 5, backoff: time.Second, maxBackoff: 5 * time.Minute}},
+		{Logging, retryPolicy{maxAttempts: 5, backoff: time.Second, maxBackoff: 5 * time.Minute}},
+		{Send, retryPolicy{maxAttempts: 8, backoff: 10 * time.Second, maxBackoff: 5 * time.Minute}},
+		{"unknown", retryPolicy{maxAttempts: 5, backoff: time.Second, maxBackoff: 5 * time.Minute}},
+	}
+	for _, tt := range tests {
+		if got := r.policy(tt.action); got != tt.want {
+			t.Errorf("%q: got %s, want %s", tt.action, got, tt.want)
+		}
+	}
+
+	t.Setenv("RETRY_BACKOFF", "soon")
+	if _, err := loadRetryPolicies(); err == nil {
+		t.Error("invalid backoff accepted")
+	}
+}
+
+func TestHeaderInt(t *testing.T) {
+	tests := []struct {
+		value any
+		want  int
+	}{
+		{nil, 0},
+		{int32(3), 3},
+		{int64(4), 4},
+		{uint8(5), 5},
+		{float64(6), 6},
+		{"7", 7},
+		{"x", 0},
+		{true, 0},
+	}
+	for _, tt := range tests {
+		if got := headerInt(amqp.Table{"n": tt.value}, "n"); got != tt.want {
+			t.Errorf("%#v: got %d, want %d", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestPublishingFromDelivery(t *testing.T) {
+	msg := amqp.Delivery{
+		Headers:       amqp.Table{retryCountHeader: int32(1)},
+		RoutingKey:    "broker",
+		ContentType:   "application/json",
+		Priority:      4,
+		CorrelationId: "job",
+		ReplyTo:       replyQueueName,
+		Body:          []byte("{}"),
+	}
+	out := publishingFromDelivery(msg)
+	if out.Headers[originalRoutingKeyHeader] != "broker" || out.CorrelationId != "job" || out.Priority != 4 || string(out.Body) != "{}" {
+		t.Errorf("got %+v", out)
+	}
+	out.Headers[lastErrorHeader] = "failed"
+	if _, ok := msg.Headers[lastErrorHeader]; ok {
+		t.Error("headers of the delivery were changed")
+	}
+
+	// a message retried from a delay queue keeps its original queue
+	msg.Headers[originalRoutingKeyHeader] = "broker.priority"
+	msg.RoutingKey = "broker.retry.1000"
+	if out := publishingFromDelivery(msg); out.Headers[originalRoutingKeyHeader] != "broker.priority" {
+		t.Errorf("original routing key %v", out.Headers[originalRoutingKeyHeader])
+	}
+}
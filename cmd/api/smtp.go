@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	SMTP_MODE         = "off"
+	SMTP_PORT         = 587
+	SMTP_TLS          = "starttls"
+	SMTP_POOL_SIZE    = 4
+	SMTP_TIMEOUT      = "10s"
+	SMTP_IDLE_TIMEOUT = "30s"
+)
+
+// smtpTransport sends emails straight to an SMTP server, either instead
+// of the mail service (primary) or when it can't be reached (fallback).
+// Connections are kept open and reused up to SMTP_POOL_SIZE.
+type smtpTransport struct {
+	mode        string
+	host        string
+	addr        string
+	tlsMode     string
+	auth        smtp.Auth
+	from        string
+	helo        string
+	timeout     time.Duration
+	idleTimeout time.Duration
+	slots       chan struct{}
+	idle        chan *smtpConn
+	fallbacks   *counter
+}
+
+type smtpConn struct {
+	conn     net.Conn
+	client   *smtp.Client
+	lastUsed time.Time
+}
+
+// loadSMTPTransport returns nil unless SMTP_MODE is primary or fallback.
+func loadSMTPTransport(metrics *metricsRegistry) (*smtpTransport, error) {
+	mode := getEnv("SMTP_MODE", SMTP_MODE)
+	switch mode {
+	case "off":
+		return nil, nil
+	case "primary", "fallback":
+	default:
+		return nil, fmt.Errorf("invalid SMTP_MODE %q, expected off, primary or fallback", mode)
+	}
+	host := getEnv("SMTP_HOST", "")
+	if host == "" {
+		return nil, errors.New("SMTP_HOST is required")
+	}
+	port, err := getEnvInt("SMTP_PORT", SMTP_PORT)
+	if err != nil {
+		return nil, err
+	}
+	tlsMode := getEnv("SMTP_TLS", SMTP_TLS)
+	switch tlsMode {
+	case "starttls", "tls", "none":
+	default:
+		return nil, fmt.Errorf("invalid SMTP_TLS %q, expected starttls, tls or none", tlsMode)
+	}
+	poolSize, err := getEnvInt("SMTP_POOL_SIZE", SMTP_POOL_SIZE)
+	if err != nil {
+		return nil, err
+	}
+	poolSize = clamp(poolSize, 1, 100)
+	timeout, err := getEnvDuration("SMTP_TIMEOUT", SMTP_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+	idleTimeout, err := getEnvDuration("SMTP_IDLE_TIMEOUT", SMTP_IDLE_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+	t := &smtpTransport{
+		mode:        mode,
+		host:        host,
+		addr:        net.JoinHostPort(host, strconv.Itoa(port)),
+		tlsMode:     tlsMode,
+		from:        getEnv("SMTP_FROM", ""),
+		helo:        getEnv("SMTP_HELO", "localhost"),
+		timeout:     timeout,
+		idleTimeout: idleTimeout,
+		slots:       make(chan struct{}, poolSize),
+		idle:        make(chan *smtpConn, poolSize),
+		fallbacks:   metrics.counter("broker_mail_smtp_fallbacks_total", "Emails sent over SMTP because the mail service was unavailable."),
+	}
+	if username := getEnv("SMTP_USERNAME", ""); username != "" {
+		// PlainAuth refuses to send credentials over an unencrypted
+		// connection unless the server is on localhost.
+		t.auth = smtp.PlainAuth("", username, getEnv("SMTP_PASSWORD", ""), host)
+	}
+	return t, nil
+}
+
+// send delivers request to every recipient and returns the message id.
+func (t *smtpTransport) send(ctx context.Context, request sendType, attachments *attachmentLimits) (string, error) {
+	from := request.From
+	if from == "" {
+		from = t.from
+	}
+	sender, err := mail.ParseAddress(from)
+	if err != nil {
+		return "", errors.New("The email has no valid sender")
+	}
+	sender.Name = request.FromName
+	var recipients []string
+	for _, list := range []addressList{request.To, request.CC, request.BCC} {
+		for _, address := range list {
+			parsed, err := mail.ParseAddress(address)
+			if err != nil {
+				return "", fmt.Errorf("Invalid recipient %q", address)
+			}
+			recipients = append(recipients, parsed.Address)
+		}
+	}
+	messageID := "<" + newID() + "@" + t.helo + ">"
+	message, err := buildMessage(request, sender, messageID, attachments)
+	if err != nil {
+		return "", err
+	}
+
+	select {
+	case t.slots <- struct{}{}:
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+	defer func() { <-t.slots }()
+	conn, err := t.get(ctx)
+	if err != nil {
+		return "", err
+	}
+	err = conn.deliver(ctx, t.timeout, sender.Address, recipients, message)
+	t.put(conn, err)
+	if err != nil {
+		return "", err
+	}
+	return messageID, nil
+}
+
+// sendEmail sends request over SMTP in primary mode. In fallback mode it
+// only does when the mail service is unavailable.
+func (c *Config) sendEmail(ctx context.Context, request sendType) (jsonResponse, error) {
+	if c.smtp != nil && c.smtp.mode == "primary" {
+		return c.sendViaSMTP(ctx, request)
+	}
+	payload, err := c.sendViaService(ctx, request)
+	if c.smtp != nil && errors.Is(err, errMailUnavailable) {
+		log.Println("mail service unavailable, sending over smtp")
+		c.smtp.fallbacks.inc()
+		return c.sendViaSMTP(ctx, request)
+	}
+	return payload, err
+}
+
+func (c *Config) sendViaSMTP(ctx context.Context, request sendType) (jsonResponse, error) {
+	messageID, err := c.smtp.send(ctx, request, c.attachments)
+	if err != nil {
+		log.Println("smtp:", err)
+		return jsonResponse{}, errors.New("Sending Email failed")
+	}
+	var payload jsonResponse
+	payload.Error = false
+	payload.Message = "Email Sent"
+	payload.Data = map[string]string{"message_id": messageID, "transport": "smtp"}
+	return payload, nil
+}
+
+// get returns an idle connection that still answers, or dials a new one.
+func (t *smtpTransport) get(ctx context.Context) (*smtpConn, error) {
+	for {
+		select {
+		case conn := <-t.idle:
+			conn.conn.SetDeadline(time.Now().Add(t.timeout))
+			if time.Since(conn.lastUsed) > t.idleTimeout || conn.client.Noop() != nil {
+				conn.client.Close()
+				continue
+			}
+			return conn, nil
+		default:
+			return t.dial(ctx)
+		}
+	}
+}
+
+// put returns conn to the pool, or closes it if it failed.
+func (t *smtpTransport) put(conn *smtpConn, err error) {
+	if err == nil {
+		err = conn.client.Reset()
+	}
+	if err != nil {
+		conn.client.Close()
+		return
+	}
+	conn.lastUsed = time.Now()
+	select {
+	case t.idle <- conn:
+	default:
+		conn.client.Quit()
+	}
+}
+
+func (t *smtpTransport) dial(ctx context.Context) (*smtpConn, error) {
+	dialer := &net.Dialer{Timeout: t.timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", t.addr)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(t.timeout))
+	if t.tlsMode == "tls" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: t.host})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	client, err := smtp.NewClient(conn, t.host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := t.handshake(client); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return &smtpConn{conn: conn, client: client, lastUsed: time.Now()}, nil
+}
+
+// handshake greets the server, upgrades to TLS and authenticates.
+func (t *smtpTransport) handshake(client *smtp.Client) error {
+	if err := client.Hello(t.helo); err != nil {
+		return err
+	}
+	if t.tlsMode == "starttls" {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			return errors.New("smtp server does not support STARTTLS")
+		}
+		if err := client.StartTLS(&tls.Config{ServerName: t.host}); err != nil {
+			return err
+		}
+	}
+	if t.auth != nil {
+		if ok, _ := client.Extension("AUTH"); !ok {
+			return errors.New("smtp server does not support AUTH")
+		}
+		if err := client.Auth(t.auth); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *smtpConn) deliver(ctx context.Context, timeout time.Duration, from string, to []string, message []byte) error {
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	c.conn.SetDeadline(deadline)
+	if err := c.client.Mail(from); err != nil {
+		return err
+	}
+	for _, rcpt := range to {
+		if err := c.client.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+	wc, err := c.client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := wc.Write(message); err != nil {
+		wc.Close()
+		return err
+	}
+	return wc.Close()
+}
+
+// buildMessage renders request as a MIME message. Bcc recipients are
+// left out of the headers.
+func buildMessage(request sendType, from *mail.Address, messageID string, attachments *attachmentLimits) ([]byte, error) {
+	var buf bytes.Buffer
+	header := textproto.MIMEHeader{}
+	header.Set("From", from.String())
+	if len(request.To) > 0 {
+		header.Set("To", strings.Join(request.To, ", "))
+	}
+	if len(request.CC) > 0 {
+		header.Set("Cc", strings.Join(request.CC, ", "))
+	}
+	if request.ReplyTo != "" {
+		header.Set("Reply-To", request.ReplyTo)
+	}
+	header.Set("Subject", mime.QEncoding.Encode("utf-8", request.Subject))
+	header.Set("Date", time.Now().Format(time.RFC1123Z))
+	header.Set("Message-Id", messageID)
+	header.Set("Mime-Version", "1.0")
+	for name, value := range request.Headers {
+		header.Set(name, value)
+	}
+
+	body := multipart.NewWriter(&buf)
+	if len(request.Files) == 0 {
+		header.Set("Content-Type", "multipart/alternative; boundary="+body.Boundary())
+		writeHeader(&buf, header)
+		if err := writeAlternatives(body, request); err != nil {
+			return nil, err
+		}
+		body.Close()
+		return buf.Bytes(), nil
+	}
+
+	header.Set("Content-Type", "multipart/mixed; boundary="+body.Boundary())
+	writeHeader(&buf, header)
+	var alternatives bytes.Buffer
+	alternative := multipart.NewWriter(&alternatives)
+	if err := writeAlternatives(alternative, request); err != nil {
+		return nil, err
+	}
+	alternative.Close()
+	part, err := body.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {"multipart/alternative; boundary=" + alternative.Boundary()},
+	})
+	if err != nil {
+		return nil, err
+	}
+	part.Write(alternatives.Bytes())
+	for _, file := range request.Files {
+		data, err := attachments.read(file)
+		if err != nil {
+			return nil, fmt.Errorf("attachment %s: %w", file.Filename, err)
+		}
+		part, err := body.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {mime.FormatMediaType(file.ContentType, map[string]string{"name": file.Filename})},
+			"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": file.Filename})},
+			"Content-Transfer-Encoding": {"base64"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		writeBase64(part, data)
+	}
+	body.Close()
+	return buf.Bytes(), nil
+}
+
+// writeAlternatives writes the text and HTML versions of the body. A
+// body without a plain_text version is sent as whatever it looks like.
+func writeAlternatives(w *multipart.Writer, request sendType) error {
+	type alternative struct{ contentType, content string }
+	var parts []alternative
+	if request.PlainText != "" {
+		parts = append(parts, alternative{"text/plain; charset=utf-8", request.PlainText})
+		parts = append(parts, alternative{"text/html; charset=utf-8", request.Body})
+	} else {
+		parts = append(parts, alternative{http.DetectContentType([]byte(request.Body)), request.Body})
+	}
+	for _, p := range parts {
+		part, err := w.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {p.contentType},
+			"Content-Transfer-Encoding": {"base64"},
+		})
+		if err != nil {
+			return err
+		}
+		writeBase64(part, []byte(p.content))
+	}
+	return nil
+}
+
+func writeHeader(w io.Writer, header textproto.MIMEHeader) {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "%s: %s\r\n", name, header.Get(name))
+	}
+	io.WriteString(w, "\r\n")
+}
+
+// writeBase64 writes data base64 encoded in lines of 76 characters.
+func writeBase64(w io.Writer, data []byte) {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	for len(encoded) > 76 {
+		io.WriteString(w, encoded[:76]+"\r\n")
+		encoded = encoded[76:]
+	}
+	io.WriteString(w, encoded+"\r\n")
+}
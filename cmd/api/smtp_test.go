@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"net"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// smtpSink is an SMTP server that accepts every message and keeps it.
+type smtpSink struct {
+	listener net.Listener
+	mu       sync.Mutex
+	messages []sinkMessage
+	conns    int
+}
+
+type sinkMessage struct {
+	from string
+	to   []string
+	data string
+}
+
+func newSMTPSink(t *testing.T) *smtpSink {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &smtpSink{listener: listener}
+	go s.serve()
+	t.Cleanup(func() { listener.Close() })
+	return s
+}
+
+func (s *smtpSink) port() string {
+	_, port, _ := net.SplitHostPort(s.listener.Addr().String())
+	return port
+}
+
+func (s *smtpSink) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns++
+		s.mu.Unlock()
+		go s.session(conn)
+	}
+}
+
+func (s *smtpSink) session(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+	reply("220 sink ready")
+	var msg sinkMessage
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch verb {
+		case "EHLO", "HELO":
+			reply("250 sink")
+		case "MAIL":
+			msg = sinkMessage{from: line[len("MAIL FROM:"):]}
+			reply("250 ok")
+		case "RCPT":
+			msg.to = append(msg.to, line[len("RCPT TO:"):])
+			reply("250 ok")
+		case "DATA":
+			reply("354 go ahead")
+			var data strings.Builder
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				data.WriteString(l)
+			}
+			msg.data = data.String()
+			s.mu.Lock()
+			s.messages = append(s.messages, msg)
+			s.mu.Unlock()
+			reply("250 queued")
+		case "RSET", "NOOP":
+			reply("250 ok")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("502 not implemented")
+		}
+	}
+}
+
+func (s *smtpSink) received() ([]sinkMessage, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]sinkMessage(nil), s.messages...), s.conns
+}
+
+func newTestSMTPTransport(t *testing.T, sink *smtpSink) *smtpTransport {
+	t.Helper()
+	t.Setenv("SMTP_MODE", "primary")
+	t.Setenv("SMTP_HOST", "127.0.0.1")
+	t.Setenv("SMTP_PORT", sink.port())
+	t.Setenv("SMTP_TLS", "none")
+	t.Setenv("SMTP_FROM", "broker@example.com")
+	transport, err := loadSMTPTransport(newMetricsRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return transport
+}
+
+func testAttachmentLimits(t *testing.T, mode string) *attachmentLimits {
+	t.Helper()
+	t.Setenv("MAIL_ATTACHMENT_MODE", mode)
+	t.Setenv("MAIL_ATTACHMENT_DIR", t.TempDir())
+	t.Setenv("MAIL_ATTACHMENT_BASE_URL", "http://broker.test")
+	limits, err := loadAttachmentLimits()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return limits
+}
+
+func TestSMTPSend(t *testing.T) {
+	sink := newSMTPSink(t)
+	transport := newTestSMTPTransport(t, sink)
+	limits := testAttachmentLimits(t, "store")
+	if err := os.WriteFile(filepath.Join(limits.dir, "stored"), []byte("stored report"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		request sendType
+		wantErr bool
+		want    []string
+		rcpts   int
+	}{
+		{
+			name:    "plain",
+			request: sendType{To: addressList{"to@example.com"}, Subject: "Hello", Body: "plain body"},
+			want:    []string{"From: <broker@example.com>", "To: to@example.com", "Subject: Hello", base64.StdEncoding.EncodeToString([]byte("plain body"))},
+			rcpts:   1,
+		},
+		{
+			name: "bcc stays out of the headers",
+			request: sendType{
+				To:  addressList{"to@example.com"},
+				CC:  addressList{"cc@example.com"},
+				BCC: addressList{"hidden@example.com"},
+				Headers: map[string]string{
+					"X-Campaign": "spring",
+				},
+				Body: "body",
+			},
+			want:  []string{"Cc: cc@example.com", "X-Campaign: spring"},
+			rcpts: 3,
+		},
+		{
+			name: "inline attachment",
+			request: sendType{
+				To:    addressList{"to@example.com"},
+				Body:  "body",
+				Files: []attachmentType{{Filename: "a.txt", ContentType: "text/plain", Data: base64.StdEncoding.EncodeToString([]byte("inline file"))}},
+			},
+			want:  []string{"multipart/mixed", "filename=a.txt", base64.StdEncoding.EncodeToString([]byte("inline file"))},
+			rcpts: 1,
+		},
+		{
+			name: "stored attachment is read from disk",
+			request: sendType{
+				To:    addressList{"to@example.com"},
+				Body:  "body",
+				Files: []attachmentType{{Filename: "r.txt", ContentType: "text/plain", URL: "http://broker.test/attachments/stored"}},
+			},
+			want:  []string{base64.StdEncoding.EncodeToString([]byte("stored report"))},
+			rcpts: 1,
+		},
+		{
+			name: "foreign url is not fetched",
+			request: sendType{
+				To:    addressList{"to@example.com"},
+				Files: []attachmentType{{Filename: "x", ContentType: "text/plain", URL: "http://169.254.169.254/latest/meta-data"}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "path outside the store",
+			request: sendType{
+				To:    addressList{"to@example.com"},
+				Files: []attachmentType{{Filename: "x", ContentType: "text/plain", URL: "http://broker.test/attachments/../../etc/passwd"}},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before, _ := sink.received()
+			id, err := transport.send(context.Background(), tt.request, limits)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				if after, _ := sink.received(); len(after) != len(before) {
+					t.Fatal("message was delivered")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			after, _ := sink.received()
+			if len(after) != len(before)+1 {
+				t.Fatalf("got %d new messages, want 1", len(after)-len(before))
+			}
+			msg := after[len(after)-1]
+			if len(msg.to) != tt.rcpts {
+				t.Errorf("got %d recipients, want %d", len(msg.to), tt.rcpts)
+			}
+			if strings.Contains(msg.data, "hidden@example.com") {
+				t.Error("bcc recipient in the message")
+			}
+			if !strings.Contains(msg.data, "Message-Id: "+id) {
+				t.Errorf("message id %s not in the message", id)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(msg.data, want) {
+					t.Errorf("message lacks %q:\n%s", want, msg.data)
+				}
+			}
+			if _, err := mail.ReadMessage(strings.NewReader(msg.data)); err != nil {
+				t.Errorf("message doesn't parse: %v", err)
+			}
+		})
+	}
+}
+
+func TestSMTPReusesConnections(t *testing.T) {
+	sink := newSMTPSink(t)
+	transport := newTestSMTPTransport(t, sink)
+	limits := testAttachmentLimits(t, "base64")
+	for i := 0; i < 3; i++ {
+		request := sendType{To: addressList{"to" + strconv.Itoa(i) + "@example.com"}, Body: "body"}
+		if _, err := transport.send(context.Background(), request, limits); err != nil {
+			t.Fatal(err)
+		}
+	}
+	messages, conns := sink.received()
+	if len(messages) != 3 || conns != 1 {
+		t.Fatalf("got %d messages over %d connections, want 3 over 1", len(messages), conns)
+	}
+}
+
+func TestSMTPDropsIdleConnections(t *testing.T) {
+	sink := newSMTPSink(t)
+	t.Setenv("SMTP_IDLE_TIMEOUT", "1ms")
+	transport := newTestSMTPTransport(t, sink)
+	limits := testAttachmentLimits(t, "base64")
+	for i := 0; i < 2; i++ {
+		if _, err := transport.send(context.Background(), sendType{To: addressList{"to@example.com"}, Body: "body"}, limits); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if _, conns := sink.received(); conns != 2 {
+		t.Fatalf("got %d connections, want 2", conns)
+	}
+}
+
+func TestSMTPSendFromWorker(t *testing.T) {
+	sink := newSMTPSink(t)
+	c := testWorkerConfig(t, sink)
+	if err := os.WriteFile(filepath.Join(c.attachments.dir, "stored"), []byte("stored report"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	request := requestType{
+		Action: Send,
+		Send: sendType{
+			To:    addressList{"to@example.com"},
+			Body:  "body",
+			Files: []attachmentType{{Filename: "r.txt", ContentType: "text/plain", Size: 13, URL: "http://broker.test/attachments/stored"}},
+		},
+	}
+	if _, err := c.runAction(context.Background(), request); err != nil {
+		t.Fatal(err)
+	}
+	messages, _ := sink.received()
+	if len(messages) != 1 || !strings.Contains(messages[0].data, base64.StdEncoding.EncodeToString([]byte("stored report"))) {
+		t.Fatalf("got %d messages, want one with the stored file", len(messages))
+	}
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+const (
+	SUPPRESSION_FILE = "suppressions.json"
+	SUPPRESSION_MODE = "filter"
+)
+
+var errSuppressed = errors.New("Suppressed recipient")
+
+// suppression is an address no email is sent to, e.g. because it
+// bounced or complained.
+type suppression struct {
+	Address   string    `json:"address"`
+	Reason    string    `json:"reason"`
+	Detail    string    `json:"detail,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+var suppressionReasons = map[string]bool{
+	"bounce":      true,
+	"complaint":   true,
+	"unsubscribe": true,
+	"manual":      true,
+}
+
+// suppressionStore keeps the suppression list in SUPPRESSION_FILE. The
+// file is read again when it changes, so the worker sees the addresses
+// added on the server. Writes are only serialized within the process,
+// so the list is meant for a single host with a single writer.
+type suppressionStore struct {
+	mu      sync.Mutex
+	path    string
+	mode    string
+	modTime time.Time
+	entries map[string]suppression
+}
+
+func openSuppressionStore() (*suppressionStore, error) {
+	s := &suppressionStore{
+		path:    getEnv("SUPPRESSION_FILE", SUPPRESSION_FILE),
+		mode:    getEnv("SUPPRESSION_MODE", SUPPRESSION_MODE),
+		entries: make(map[string]suppression),
+	}
+	if s.mode != "filter" && s.mode != "reject" {
+		return nil, fmt.Errorf("invalid SUPPRESSION_MODE %q, expected filter or reject", s.mode)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// reload reads the file if it changed since it was last read. The
+// caller must hold s.mu.
+func (s *suppressionStore) reload() error {
+	info, err := os.Stat(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(s.modTime) {
+		return nil
+	}
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	var list []suppression
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("%s: %w", s.path, err)
+	}
+	s.entries = make(map[string]suppression, len(list))
+	for _, entry := range list {
+		s.entries[entry.Address] = entry
+	}
+	s.modTime = info.ModTime()
+	return nil
+}
+
+// save writes the list to a temporary file and renames it over the
+// store. The caller must hold s.mu.
+func (s *suppressionStore) save() error {
+	data, err := json.MarshalIndent(s.sorted(), "", "  ")
+	if err != nil {
+		return err
+	}
+	if dir := filepath.Dir(s.path); dir != "." {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return err
+		}
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	if info, err := os.Stat(s.path); err == nil {
+		s.modTime = info.ModTime()
+	}
+	return nil
+}
+
+func (s *suppressionStore) sorted() []suppression {
+	list := make([]suppression, 0, len(s.entries))
+	for _, entry := range s.entries {
+		list = append(list, entry)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Address < list[j].Address })
+	return list
+}
+
+func (s *suppressionStore) add(entries ...suppression) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.reload(); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		s.entries[entry.Address] = entry
+	}
+	return s.save()
+}
+
+func (s *suppressionStore) remove(address string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.reload(); err != nil {
+		return false, err
+	}
+	if _, ok := s.entries[address]; !ok {
+		return false, nil
+	}
+	delete(s.entries, address)
+	return true, s.save()
+}
+
+func (s *suppressionStore) get(address string) (suppression, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.reload(); err != nil {
+		log.Println("suppressions:", err)
+	}
+	entry, ok := s.entries[address]
+	return entry, ok
+}
+
+func (s *suppressionStore) list() []suppression {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.reload(); err != nil {
+		log.Println("suppressions:", err)
+	}
+	return s.sorted()
+}
+
+// normalizeAddress returns the lower case address part of address.
+func normalizeAddress(address string) (string, error) {
+	parsed, err := mail.ParseAddress(address)
+	if err != nil {
+		return "", fmt.Errorf("Invalid address %q", address)
+	}
+	return strings.ToLower(parsed.Address), nil
+}
+
+// applySuppressions rejects the email if it has a suppressed recipient,
+// or with SUPPRESSION_MODE=filter drops those recipients and only fails
+// when none is left.
+func (c *Config) applySuppressions(request *sendType) error {
+	filter := func(list addressList) (addressList, error) {
+		var kept addressList
+		for _, address := range list {
+			normalized, err := normalizeAddress(address)
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := c.suppressions.get(normalized); !ok {
+				kept = append(kept, address)
+				continue
+			}
+			if c.suppressions.mode == "reject" {
+				return nil, fmt.Errorf("%w: %s", errSuppressed, normalized)
+			}
+			log.Printf("suppressions: not sending to %s\n", normalized)
+		}
+		return kept, nil
+	}
+	var err error
+	if request.To, err = filter(request.To); err != nil {
+		return err
+	}
+	if request.CC, err = filter(request.CC); err != nil {
+		return err
+	}
+	if request.BCC, err = filter(request.BCC); err != nil {
+		return err
+	}
+	if len(request.To)+len(request.CC)+len(request.BCC) == 0 {
+		return fmt.Errorf("%w: no recipients left", errSuppressed)
+	}
+	return nil
+}
+
+type suppressionRequest struct {
+	Addresses []string `json:"addresses"`
+	Reason    string   `json:"reason"`
+	Detail    string   `json:"detail"`
+}
+
+// newSuppressions checks the addresses and reason of a request to
+// suppress them.
+func newSuppressions(addresses []string, reason, detail string) ([]suppression, error) {
+	if len(addresses) == 0 {
+		return nil, errors.New("No addresses given")
+	}
+	if !suppressionReasons[reason] {
+		return nil, fmt.Errorf("Invalid reason %q", reason)
+	}
+	entries := make([]suppression, 0, len(addresses))
+	for _, address := range addresses {
+		normalized, err := normalizeAddress(address)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, suppression{
+			Address:   normalized,
+			Reason:    reason,
+			Detail:    detail,
+			CreatedAt: time.Now().UTC(),
+		})
+	}
+	return entries, nil
+}
+
+func (c *Config) listSuppressions(w http.ResponseWriter, r *http.Request) {
+	response := jsonResponse{
+		Error:   false,
+		Message: "Suppressions",
+		Data:    c.suppressions.list(),
+	}
+	c.writeJSON(w, http.StatusOK, response)
+}
+
+func (c *Config) getSuppression(w http.ResponseWriter, r *http.Request) {
+	address, err := normalizeAddress(chi.URLParam(r, "address"))
+	if err != nil {
+		c.ErrorJSON(w, err)
+		return
+	}
+	entry, ok := c.suppressions.get(address)
+	if !ok {
+		c.ErrorJSON(w, errors.New("Address is not suppressed"), http.StatusNotFound)
+		return
+	}
+	response := jsonResponse{
+		Error:   false,
+		Message: "Address is suppressed",
+		Data:    entry,
+	}
+	c.writeJSON(w, http.StatusOK, response)
+}
+
+func (c *Config) addSuppressions(w http.ResponseWriter, r *http.Request) {
+	var request suppressionRequest
+	if err := c.readJSON(w, r, &request); err != nil {
+		c.ErrorJSON(w, err)
+		return
+	}
+	if request.Reason == "" {
+		request.Reason = "manual"
+	}
+	entries, err := newSuppressions(request.Addresses, request.Reason, request.Detail)
+	if err != nil {
+		c.ErrorJSON(w, err)
+		return
+	}
+	if err := c.suppressions.add(entries...); err != nil {
+		c.ErrorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+	response := jsonResponse{
+		Error:   false,
+		Message: "Addresses suppressed",
+		Data:    entries,
+	}
+	c.writeJSON(w, http.StatusCreated, response)
+}
+
+func (c *Config) removeSuppression(w http.ResponseWriter, r *http.Request) {
+	address, err := normalizeAddress(chi.URLParam(r, "address"))
+	if err != nil {
+		c.ErrorJSON(w, err)
+		return
+	}
+	removed, err := c.suppressions.remove(address)
+	if err != nil {
+		c.ErrorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+	if !removed {
+		c.ErrorJSON(w, errors.New("Address is not suppressed"), http.StatusNotFound)
+		return
+	}
+	response := jsonResponse{
+		Error:   false,
+		Message: "Address removed",
+	}
+	c.writeJSON(w, http.StatusOK, response)
+}
+
+// mailEvent is a bounce or complaint notification from the mail
+// provider.
+type mailEvent struct {
+	Type       string   `json:"type"`
+	BounceType string   `json:"bounce_type"`
+	Recipients []string `json:"recipients"`
+	Detail     string   `json:"detail"`
+}
+
+// handleMailEvents suppresses the recipients of hard bounces and
+// complaints. Soft bounces are only logged. The webhook is disabled
+// unless SUPPRESSION_WEBHOOK_TOKEN is set.
+func (c *Config) handleMailEvents(w http.ResponseWriter, r *http.Request) {
+	token := os.Getenv("SUPPRESSION_WEBHOOK_TOKEN")
+	if token == "" {
+		c.ErrorJSON(w, errors.New("Webhook is disabled"), http.StatusForbidden)
+		return
+	}
+	if !hasBearerToken(r, token) {
+		c.ErrorJSON(w, errors.New("Unauthorized"), http.StatusUnauthorized)
+		return
+	}
+	var event mailEvent
+	if err := c.readJSON(w, r, &event); err != nil {
+		c.ErrorJSON(w, err)
+		return
+	}
+	switch {
+	case event.Type == "bounce" && event.BounceType == "soft":
+		log.Printf("suppressions: soft bounce for %s: %s\n", strings.Join(event.Recipients, ", "), event.Detail)
+		c.writeJSON(w, http.StatusOK, jsonResponse{Error: false, Message: "Soft bounce ignored"})
+		return
+	case event.Type == "bounce", event.Type == "complaint":
+	default:
+		c.ErrorJSON(w, fmt.Errorf("Invalid event type %q", event.Type))
+		return
+	}
+	entries, err := newSuppressions(event.Recipients, event.Type, event.Detail)
+	if err != nil {
+		c.ErrorJSON(w, err)
+		return
+	}
+	if err := c.suppressions.add(entries...); err != nil {
+		c.ErrorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+	response := jsonResponse{
+		Error:   false,
+		Message: "Addresses suppressed",
+		Data:    entries,
+	}
+	c.writeJSON(w, http.StatusOK, response)
+}
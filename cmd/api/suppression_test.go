@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func openTestSuppressions(t *testing.T, mode string) *suppressionStore {
+	t.Helper()
+	t.Setenv("SUPPRESSION_FILE", filepath.Join(t.TempDir(), "suppressions.json"))
+	t.Setenv("SUPPRESSION_MODE", mode)
+	s, err := openSuppressionStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestApplySuppressions(t *testing.T) {
+	tests := []struct {
+		name    string
+		mode    string
+		request sendType
+		want    sendType
+		wantErr bool
+	}{
+		{"filter drops suppressed", "filter",
+			sendType{To: addressList{"a@example.com", "Gone <GONE@example.com>"}, BCC: addressList{"gone@example.com"}},
+			sendType{To: addressList{"a@example.com"}}, false},
+		{"filter fails with nobody left", "filter", sendType{To: addressList{"gone@example.com"}}, sendType{}, true},
+		{"reject fails", "reject", sendType{To: addressList{"a@example.com"}, CC: addressList{"gone@example.com"}}, sendType{}, true},
+		{"reject passes others", "reject", sendType{To: addressList{"a@example.com"}}, sendType{To: addressList{"a@example.com"}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := openTestSuppressions(t, tt.mode)
+			entries, err := newSuppressions([]string{"gone@example.com"}, "bounce", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := s.add(entries...); err != nil {
+				t.Fatal(err)
+			}
+			c := &Config{suppressions: s}
+			request := tt.request
+			err = c.applySuppressions(&request)
+			if tt.wantErr {
+				if !errors.Is(err, errSuppressed) {
+					t.Errorf("got %v, want a suppressed error", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(request, tt.want) {
+				t.Errorf("got %+v, want %+v", request, tt.want)
+			}
+		})
+	}
+}
+
+func TestSuppressionStoreReloads(t *testing.T) {
+	s := openTestSuppressions(t, "filter")
+	if err := s.add(suppression{Address: "a@example.com", Reason: "manual"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// another process replaces the file
+	data := `[{"address":"b@example.com","reason":"bounce"}]`
+	if err := os.WriteFile(s.path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Second)
+	os.Chtimes(s.path, later, later)
+	if _, ok := s.get("a@example.com"); ok {
+		t.Error("a@example.com still suppressed")
+	}
+	if _, ok := s.get("b@example.com"); !ok {
+		t.Error("b@example.com not suppressed")
+	}
+
+	if removed, err := s.remove("b@example.com"); !removed || err != nil {
+		t.Fatalf("remove: %v, %v", removed, err)
+	}
+	reopened, err := openSuppressionStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list := reopened.list(); len(list) != 0 {
+		t.Errorf("got %v after removing everything", list)
+	}
+}
+
+func TestNewSuppressions(t *testing.T) {
+	tests := []struct {
+		name      string
+		addresses []string
+		reason    string
+		want      string
+		wantErr   bool
+	}{
+		{"normalized", []string{"Ann <ANN@Example.com>"}, "complaint", "ann@example.com", false},
+		{"no addresses", nil, "manual", "", true},
+		{"unknown reason", []string{"a@example.com"}, "spam", "", true},
+		{"invalid address", []string{"not an address"}, "manual", "", true},
+	}
+	for _, tt := range tests {
+		entries, err := newSuppressions(tt.addresses, tt.reason, "")
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: err = %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && entries[0].Address != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, entries[0].Address, tt.want)
+		}
+	}
+}
+
+func TestHandleMailEvents(t *testing.T) {
+	t.Setenv("SUPPRESSION_WEBHOOK_TOKEN", "secret")
+	c := &Config{suppressions: openTestSuppressions(t, "filter")}
+	tests := []struct {
+		name       string
+		body       string
+		want       int
+		suppressed string
+	}{
+		{"hard bounce", `{"type":"bounce","bounce_type":"hard","recipients":["hard@example.com"]}`, http.StatusOK, "hard@example.com"},
+		{"complaint", `{"type":"complaint","recipients":["angry@example.com"]}`, http.StatusOK, "angry@example.com"},
+		{"soft bounce", `{"type":"bounce","bounce_type":"soft","recipients":["soft@example.com"]}`, http.StatusOK, ""},
+		{"unknown type", `{"type":"delivery","recipients":["ok@example.com"]}`, http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/mail/events", strings.NewReader(tt.body))
+		r.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		c.handleMailEvents(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, w.Code, tt.want)
+		}
+		if tt.suppressed != "" {
+			if _, ok := c.suppressions.get(tt.suppressed); !ok {
+				t.Errorf("%s: %s not suppressed", tt.name, tt.suppressed)
+			}
+		}
+	}
+	if _, ok := c.suppressions.get("soft@example.com"); ok {
+		t.Error("soft bounce suppressed")
+	}
+}
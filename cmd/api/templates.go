@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	htmltemplate "html/template"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	texttemplate "text/template"
+
+	"github.com/go-chi/chi"
+)
+
+const MAIL_TEMPLATE_DIR = "templates"
+
+const (
+	htmlTemplateExt    = ".html.tmpl"
+	textTemplateExt    = ".txt.tmpl"
+	subjectTemplateExt = ".subject.tmpl"
+)
+
+var errTemplateNotFound = errors.New("Template not found")
+
+// mailTemplate is one template name with its optional HTML, text and
+// subject parts.
+type mailTemplate struct {
+	html    *htmltemplate.Template
+	text    *texttemplate.Template
+	subject *texttemplate.Template
+}
+
+// mailTemplates are loaded from MAIL_TEMPLATE_DIR. welcome.html.tmpl,
+// welcome.txt.tmpl and welcome.subject.tmpl make up the "welcome"
+// template; files in layouts/ and partials/ are parsed with every HTML
+// or text template of the same kind, so a page can define blocks and
+// call a layout with {{template "base" .}}.
+type mailTemplates struct {
+	templates map[string]*mailTemplate
+}
+
+type renderedMail struct {
+	Subject string `json:"subject,omitempty"`
+	HTML    string `json:"html,omitempty"`
+	Text    string `json:"text,omitempty"`
+}
+
+func loadMailTemplates() (*mailTemplates, error) {
+	dir := getEnv("MAIL_TEMPLATE_DIR", MAIL_TEMPLATE_DIR)
+	shared := func(ext string) ([]string, error) {
+		var files []string
+		for _, sub := range []string{"layouts", "partials"} {
+			matches, err := filepath.Glob(filepath.Join(dir, sub, "*"+ext))
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, matches...)
+		}
+		return files, nil
+	}
+	htmlShared, err := shared(htmlTemplateExt)
+	if err != nil {
+		return nil, err
+	}
+	textShared, err := shared(textTemplateExt)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &mailTemplates{templates: make(map[string]*mailTemplate)}
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return t, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	get := func(name string) *mailTemplate {
+		if t.templates[name] == nil {
+			t.templates[name] = &mailTemplate{}
+		}
+		return t.templates[name]
+	}
+	for _, entry := range entries {
+		file := entry.Name()
+		path := filepath.Join(dir, file)
+		switch {
+		case entry.IsDir():
+		case strings.HasSuffix(file, htmlTemplateExt):
+			page := htmltemplate.New(file).Option("missingkey=error")
+			if get(strings.TrimSuffix(file, htmlTemplateExt)).html, err = page.ParseFiles(append(htmlShared, path)...); err != nil {
+				return nil, err
+			}
+		case strings.HasSuffix(file, subjectTemplateExt):
+			page := texttemplate.New(file).Option("missingkey=error")
+			if get(strings.TrimSuffix(file, subjectTemplateExt)).subject, err = page.ParseFiles(path); err != nil {
+				return nil, err
+			}
+		case strings.HasSuffix(file, textTemplateExt):
+			page := texttemplate.New(file).Option("missingkey=error")
+			if get(strings.TrimSuffix(file, textTemplateExt)).text, err = page.ParseFiles(append(textShared, path)...); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for name, tmpl := range t.templates {
+		if tmpl.html == nil && tmpl.text == nil {
+			return nil, errors.New("template " + name + " has a subject but no body")
+		}
+	}
+	return t, nil
+}
+
+func (t *mailTemplates) names() []string {
+	names := make([]string, 0, len(t.templates))
+	for name := range t.templates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// render executes the named template with data. Missing keys are an
+// error rather than silently rendering empty values.
+func (t *mailTemplates) render(name string, data map[string]any) (renderedMail, error) {
+	var out renderedMail
+	tmpl, ok := t.templates[name]
+	if !ok {
+		return out, errTemplateNotFound
+	}
+	var buf bytes.Buffer
+	if tmpl.subject != nil {
+		if err := tmpl.subject.Execute(&buf, data); err != nil {
+			return out, err
+		}
+		out.Subject = strings.TrimSpace(buf.String())
+		buf.Reset()
+	}
+	if tmpl.html != nil {
+		if err := tmpl.html.Execute(&buf, data); err != nil {
+			return out, err
+		}
+		out.HTML = buf.String()
+		buf.Reset()
+	}
+	if tmpl.text != nil {
+		if err := tmpl.text.Execute(&buf, data); err != nil {
+			return out, err
+		}
+		out.Text = buf.String()
+	}
+	return out, nil
+}
+
+// applyTemplate renders the template of a send request into its subject
+// and body. The HTML part becomes the body with the text part as the
+// plain text alternative.
+func (c *Config) applyTemplate(request *sendType) error {
+	if request.Template == "" {
+		return nil
+	}
+	rendered, err := c.templates.render(request.Template, request.Data)
+	if err != nil {
+		return err
+	}
+	if rendered.Subject != "" {
+		request.Subject = rendered.Subject
+	}
+	request.Body = rendered.HTML
+	request.PlainText = rendered.Text
+	if request.Body == "" {
+		request.Body, request.PlainText = rendered.Text, ""
+	}
+	request.Template = ""
+	request.Data = nil
+	return nil
+}
+
+func (c *Config) listTemplates(w http.ResponseWriter, r *http.Request) {
+	response := jsonResponse{
+		Error:   false,
+		Message: "Templates",
+		Data:    c.templates.names(),
+	}
+	c.writeJSON(w, http.StatusOK, response)
+}
+
+type templateRequest struct {
+	Data map[string]any `json:"data"`
+}
+
+// previewTemplate renders a template with the data in the request.
+func (c *Config) previewTemplate(w http.ResponseWriter, r *http.Request) {
+	var request templateRequest
+	if err := c.readJSON(w, r, &request); err != nil {
+		c.ErrorJSON(w, err)
+		return
+	}
+	rendered, err := c.templates.render(chi.URLParam(r, "name"), request.Data)
+	if errors.Is(err, errTemplateNotFound) {
+		c.ErrorJSON(w, err, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		c.ErrorJSON(w, err, http.StatusUnprocessableEntity)
+		return
+	}
+	response := jsonResponse{
+		Error:   false,
+		Message: "Preview",
+		Data:    rendered,
+	}
+	c.writeJSON(w, http.StatusOK, response)
+}
+
+// validateTemplate checks that a template renders with the data in the
+// request without sending anything.
+func (c *Config) validateTemplate(w http.ResponseWriter, r *http.Request) {
+	var request templateRequest
+	if err := c.readJSON(w, r, &request); err != nil {
+		c.ErrorJSON(w, err)
+		return
+	}
+	_, err := c.templates.render(chi.URLParam(r, "name"), request.Data)
+	if errors.Is(err, errTemplateNotFound) {
+		c.ErrorJSON(w, err, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		c.ErrorJSON(w, err, http.StatusUnprocessableEntity)
+		return
+	}
+	response := jsonResponse{
+		Error:   false,
+		Message: "Template is valid",
+	}
+	c.writeJSON(w, http.StatusOK, response)
+}
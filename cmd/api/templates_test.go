@@ -0,0 +1,105 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func writeTemplates(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("MAIL_TEMPLATE_DIR", dir)
+	return dir
+}
+
+func TestRenderTemplate(t *testing.T) {
+	writeTemplates(t, map[string]string{
+		"layouts/base.html.tmpl":   `{{define "base"}}<p>{{template "content" .}}</p>{{end}}`,
+		"welcome.html.tmpl":        `{{define "content"}}Hi {{.name}}{{end}}{{template "base" .}}`,
+		"welcome.txt.tmpl":         `Hi {{.name}}`,
+		"welcome.subject.tmpl":     " Welcome {{.name}} \n",
+		"reset.txt.tmpl":           `Reset with {{.link}}`,
+		"partials/footer.txt.tmpl": `{{define "footer"}}bye{{end}}`,
+	})
+	templates, err := loadMailTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := templates.names(), []string{"reset", "welcome"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("names %v, want %v", got, want)
+	}
+
+	tests := []struct {
+		name     string
+		template string
+		data     map[string]any
+		want     renderedMail
+		wantErr  bool
+	}{
+		{"all parts", "welcome", map[string]any{"name": "<Ann>"}, renderedMail{Subject: "Welcome <Ann>", HTML: "<p>Hi &lt;Ann&gt;</p>", Text: "Hi <Ann>"}, false},
+		{"text only", "reset", map[string]any{"link": "x"}, renderedMail{Text: "Reset with x"}, false},
+		{"missing key", "reset", nil, renderedMail{}, true},
+		{"unknown template", "missing", nil, renderedMail{}, true},
+	}
+	for _, tt := range tests {
+		got, err := templates.render(tt.template, tt.data)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: err = %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && got != tt.want {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLoadTemplatesWithoutBody(t *testing.T) {
+	writeTemplates(t, map[string]string{"welcome.subject.tmpl": "Welcome"})
+	if _, err := loadMailTemplates(); err == nil {
+		t.Error("a subject without a body was accepted")
+	}
+}
+
+func TestApplyTemplate(t *testing.T) {
+	writeTemplates(t, map[string]string{
+		"welcome.html.tmpl":    `<p>Hi {{.name}}</p>`,
+		"welcome.txt.tmpl":     `Hi {{.name}}`,
+		"welcome.subject.tmpl": `Welcome`,
+		"reset.txt.tmpl":       `Reset`,
+	})
+	templates, err := loadMailTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Config{templates: templates}
+	tests := []struct {
+		name    string
+		request sendType
+		want    sendType
+	}{
+		{"html and text", sendType{Subject: "s", Template: "welcome", Data: map[string]any{"name": "Ann"}},
+			sendType{Subject: "Welcome", Body: "<p>Hi Ann</p>", PlainText: "Hi Ann"}},
+		{"text only keeps the subject", sendType{Subject: "s", Template: "reset"}, sendType{Subject: "s", Body: "Reset"}},
+		{"no template", sendType{Subject: "s", Body: "b"}, sendType{Subject: "s", Body: "b"}},
+	}
+	for _, tt := range tests {
+		request := tt.request
+		if err := c.applyTemplate(&request); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(request, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, request, tt.want)
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	WORKER_PREFETCH    = 10
+	WORKER_CONCURRENCY = 4
+	WORKER_TIMEOUT     = "30s"
+)
+
+const workerConsumerTag = "broker-worker"
+
+// worker consumes the broker queue and runs each request through the
+// same actions as /handle.
+type worker struct {
+	c           *Config
+	prefetch    int
+	concurrency int
+	timeout     time.Duration
+	retrier     *retrier
+}
+
+func work() {
+	c := newConfig()
+	defer c.conn.Close()
+
+	w := &worker{c: c}
+	var err error
+	if w.prefetch, err = getEnvInt("WORKER_PREFETCH", WORKER_PREFETCH); err != nil {
+		log.Panic(err)
+	}
+	if w.concurrency, err = getEnvInt("WORKER_CONCURRENCY", WORKER_CONCURRENCY); err != nil {
+		log.Panic(err)
+	}
+	if w.retrier, err = newRetrier(c); err != nil {
+		log.Panic(err)
+	}
+	if err := declareParkingQueue(c.ch); err != nil {
+		log.Panic("failed to declare parking lot queue: ", err)
+	}
+	if w.timeout, err = getEnvDuration("WORKER_TIMEOUT", WORKER_TIMEOUT); err != nil {
+		log.Panic(err)
+	}
+	if w.concurrency < 1 {
+		w.concurrency = 1
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	log.Printf("worker started with prefetch %d and concurrency %d...\n", w.prefetch, w.concurrency)
+	log.Printf("default retry policy: %s\n", w.retrier.policy(""))
+	// the log buffer is stopped only once the consumers have finished,
+	// so the logs of the last actions are flushed too
+	logCtx, stopLogs := context.WithCancel(context.Background())
+	var logs sync.WaitGroup
+	if c.logBuffer != nil {
+		logs.Add(1)
+		go func() {
+			defer logs.Done()
+			c.logBuffer.run(logCtx)
+		}()
+	}
+	w.run(ctx)
+	stopLogs()
+	logs.Wait()
+	log.Println("worker stopped")
+}
+
+// run consumes until ctx is done, reconnecting when the connection to
+// rabbit is lost.
+func (w *worker) run(ctx context.Context) {
+	for {
+		err := w.consume(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Println("worker: consumer stopped, reconnecting:", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+func (w *worker) consume(ctx context.Context) error {
+	// make sure the connection is up before opening the consumer channel
+	if _, err := w.c.channel(); err != nil {
+		return err
+	}
+	w.c.mu.Lock()
+	conn := w.c.conn
+	w.c.mu.Unlock()
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+	if err := ch.Qos(w.prefetch, 0, false); err != nil {
+		return err
+	}
+	// the broker queue is drained even when requests go to the priority
+	// queue, for what was queued before priorities were turned on
+	queues := []string{w.c.queue}
+	if w.c.queue != queneName {
+		queues = append(queues, queneName)
+	}
+	var sources []<-chan amqp.Delivery
+	for _, queue := range queues {
+		deliveries, err := ch.Consume(
+			queue,                       // queue
+			workerConsumerTag+"."+queue, // consumer
+			false,                       // auto-ack
+			false,                       // exclusive
+			false,                       // no-local
+			false,                       // no-wait
+			nil,                         // args
+		)
+		if err != nil {
+			return err
+		}
+		sources = append(sources, deliveries)
+	}
+	msgs := make(chan amqp.Delivery)
+	var consumers sync.WaitGroup
+	for _, deliveries := range sources {
+		consumers.Add(1)
+		go func(deliveries <-chan amqp.Delivery) {
+			defer consumers.Done()
+			for msg := range deliveries {
+				msgs <- msg
+			}
+		}(deliveries)
+	}
+	go func() {
+		consumers.Wait()
+		close(msgs)
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < w.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for msg := range msgs {
+				w.process(msg)
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-ctx.Done():
+		// stop new deliveries and let the in-flight ones finish
+		for _, queue := range queues {
+			ch.Cancel(workerConsumerTag+"."+queue, false)
+		}
+		<-done
+		return ctx.Err()
+	case <-done:
+		return errors.New("delivery channel closed")
+	}
+}
+
+func (w *worker) process(msg amqp.Delivery) {
+	// retries and the parking lot get the message still encrypted
+	plain, err := w.c.keys.open(msg)
+	if err != nil {
+		log.Println("worker: failed to decrypt message:", err)
+		w.fail(msg, errors.New("message can't be decrypted"))
+		return
+	}
+	request, err := decodeRequest(plain)
+	if err != nil {
+		log.Println("worker: invalid message:", err)
+		w.fail(msg, errors.New("invalid message"))
+		return
+	}
+	if request.Action == Send && request.Send.scheduled() {
+		w.schedule(msg, *request.Send.SendAt)
+		return
+	}
+
+	w.reply(msg, jobReply{Status: jobProcessing})
+	ctx, cancel := context.WithTimeout(context.Background(), w.timeout)
+	defer cancel()
+	if redacted, _ := msg.Headers[logRedactedHeader].(bool); redacted {
+		ctx = withLogRedacted(ctx)
+	}
+	payload, err := w.c.runAction(ctx, request)
+	if err != nil {
+		log.Printf("worker: %s action failed: %v\n", request.Action, err)
+		if errors.Is(err, errUnknownAction) || errors.Is(err, errSuppressed) {
+			w.fail(msg, err)
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		retried, retryErr := w.retrier.retry(ctx, msg, request.Action, err)
+		if retryErr != nil {
+			// keep the message rather than lose it
+			log.Println("worker: failed to schedule retry:", retryErr)
+			msg.Nack(false, true)
+			return
+		}
+		if !retried {
+			w.fail(msg, err)
+			return
+		}
+		w.reply(msg, jobReply{Status: jobProcessing, Error: "retrying: " + err.Error()})
+		msg.Ack(false)
+		return
+	}
+	w.reply(msg, jobReply{Status: jobSucceeded, Data: payload.Data})
+	msg.Ack(false)
+}
+
+// fail parks msg for good and reports the job as failed.
+func (w *worker) fail(msg amqp.Delivery, cause error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := w.retrier.park(ctx, msg, cause); err != nil {
+		log.Println("worker: failed to park message:", err)
+		msg.Nack(false, true)
+		return
+	}
+	w.reply(msg, jobReply{Status: jobFailed, Error: cause.Error()})
+	msg.Ack(false)
+}
+
+// reply reports the job status to the reply queue of the message, if
+// it asked for one.
+func (w *worker) reply(msg amqp.Delivery, reply jobReply) {
+	if msg.ReplyTo == "" {
+		return
+	}
+	reply.JobID = msg.CorrelationId
+	body, _ := json.Marshal(reply)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := w.c.publish(ctx, "", msg.ReplyTo, amqp.Publishing{
+		ContentType:   "application/json",
+		CorrelationId: msg.CorrelationId,
+		Body:          body,
+	})
+	if err != nil {
+		log.Println("worker: failed to send reply:", err)
+	}
+}
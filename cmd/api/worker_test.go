@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/base64"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// testAcknowledger records how a delivery was settled.
+type testAcknowledger struct {
+	acked, nacked bool
+}
+
+func (a *testAcknowledger) Ack(tag uint64, multiple bool) error {
+	a.acked = true
+	return nil
+}
+
+func (a *testAcknowledger) Nack(tag uint64, multiple, requeue bool) error {
+	a.nacked = true
+	return nil
+}
+
+func (a *testAcknowledger) Reject(tag uint64, requeue bool) error {
+	a.nacked = true
+	return nil
+}
+
+// testWorkerConfig loads the configuration the way the worker does,
+// sending mail to sink.
+func testWorkerConfig(t *testing.T, sink *smtpSink) *Config {
+	t.Helper()
+	dir := t.TempDir()
+	t.Setenv("SMTP_MODE", "primary")
+	t.Setenv("SMTP_HOST", "127.0.0.1")
+	t.Setenv("SMTP_PORT", sink.port())
+	t.Setenv("SMTP_TLS", "none")
+	t.Setenv("SMTP_FROM", "broker@example.com")
+	t.Setenv("MAIL_ATTACHMENT_MODE", "store")
+	t.Setenv("MAIL_ATTACHMENT_DIR", filepath.Join(dir, "attachments"))
+	t.Setenv("MAIL_ATTACHMENT_BASE_URL", "http://broker.test")
+	t.Setenv("MAIL_TEMPLATE_DIR", filepath.Join(dir, "templates"))
+	t.Setenv("SUPPRESSION_FILE", filepath.Join(dir, "suppressions.json"))
+	t.Setenv("MESSAGE_KEYS_DIR", filepath.Join(dir, "keys"))
+	return loadConfig()
+}
+
+func TestWorkerSendsFiles(t *testing.T) {
+	sink := newSMTPSink(t)
+	w := &worker{c: testWorkerConfig(t, sink), timeout: 5 * time.Second}
+	content := base64.StdEncoding.EncodeToString([]byte("queued report"))
+	publishing, err := newEnvelope(codecs[0], "id", requestType{
+		Action: Send,
+		Send: sendType{
+			To:    addressList{"to@example.com"},
+			Body:  "body",
+			Files: []attachmentType{{Filename: "r.txt", ContentType: "text/plain", Size: 13, Data: content}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	acknowledger := &testAcknowledger{}
+	w.process(amqp.Delivery{
+		Acknowledger: acknowledger,
+		Headers:      publishing.Headers,
+		ContentType:  publishing.ContentType,
+		Body:         publishing.Body,
+	})
+	if !acknowledger.acked || acknowledger.nacked {
+		t.Fatalf("message was not acked: %+v", acknowledger)
+	}
+	messages, _ := sink.received()
+	if len(messages) != 1 || !strings.Contains(messages[0].data, content) {
+		t.Fatalf("got %d messages, want one with the file", len(messages))
+	}
+}
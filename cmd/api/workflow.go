@@ -0,0 +1,578 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+const (
+	WORKFLOW_DIR       = "workflows"
+	WORKFLOW_STATE_DIR = "workflow-runs"
+	WORKFLOW_TIMEOUT   = "30s"
+	WORKFLOW_RETENTION = "24h"
+)
+
+const (
+	runRunning      = "running"
+	runSucceeded    = "succeeded"
+	runCompensating = "compensating"
+	runCompensated  = "compensated"
+	runFailed       = "failed"
+
+	stepPending            = "pending"
+	stepSucceeded          = "succeeded"
+	stepFailed             = "failed"
+	stepCompensated        = "compensated"
+	stepCompensationFailed = "compensation_failed"
+)
+
+// workflowDefinition is loaded from a JSON file in WORKFLOW_DIR, e.g.
+//
+//	{
+//	  "name": "signup",
+//	  "steps": [
+//	    {"name": "auth", "action": "authentication",
+//	     "request": {"auth": {"email": "{{input.email}}", "password": "{{input.password}}"}}},
+//	    {"name": "welcome", "action": "send",
+//	     "request": {"send": {"to": "{{steps.auth.data.email}}", "subject": "Welcome"}},
+//	     "compensate": {"action": "logging", "request": {"log": {"name": "signup", "message": "undo {{run.id}}"}}}}
+//	  ]
+//	}
+//
+// Strings in a request may reference the run input, the results of
+// earlier steps and the run id with {{...}}.
+type workflowDefinition struct {
+	Name  string         `json:"name"`
+	Steps []workflowStep `json:"steps"`
+}
+
+type workflowStep struct {
+	Name       string          `json:"name"`
+	Action     string          `json:"action"`
+	Request    json.RawMessage `json:"request"`
+	Compensate *workflowAction `json:"compensate,omitempty"`
+}
+
+type workflowAction struct {
+	Action  string          `json:"action"`
+	Request json.RawMessage `json:"request"`
+}
+
+type stepState struct {
+	Name    string `json:"name"`
+	Status  string `json:"status"`
+	Error   string `json:"error,omitempty"`
+	Message string `json:"message,omitempty"`
+	Data    any    `json:"data,omitempty"`
+}
+
+type workflowRun struct {
+	ID        string         `json:"id"`
+	Workflow  string         `json:"workflow"`
+	Status    string         `json:"status"`
+	Error     string         `json:"error,omitempty"`
+	Input     map[string]any `json:"input"`
+	Steps     []stepState    `json:"steps"`
+	CreatedAt time.Time      `json:"created_at"`
+	UpdatedAt time.Time      `json:"updated_at"`
+	// CredentialsOmitted is set on a saved run whose input had
+	// credentials left out
+	CredentialsOmitted bool `json:"credentials_omitted,omitempty"`
+}
+
+func (run *workflowRun) finished() bool {
+	switch run.Status {
+	case runSucceeded, runCompensated, runFailed:
+		return true
+	}
+	return false
+}
+
+// credentialFields are left out of the persisted input of a run. They
+// are only kept in memory, so a run interrupted by a restart can't go on
+// without them and is failed instead.
+var credentialFields = map[string]bool{
+	"password":      true,
+	"token":         true,
+	"secret":        true,
+	"authorization": true,
+}
+
+var errWorkflowNotFound = errors.New("Workflow not found")
+
+// errCredentialsLost fails a run that was interrupted and can't be
+// resumed, as its credentials weren't saved.
+var errCredentialsLost = errors.New("interrupted by a restart, its credentials weren't kept; start it again")
+
+// workflowEngine runs workflows and persists every run as a JSON file so
+// unfinished runs are resumed after a restart. Steps may therefore run
+// more than once and should be safe to repeat. Finished runs are dropped
+// once they are older than the retention window.
+type workflowEngine struct {
+	c           *Config
+	definitions map[string]workflowDefinition
+	dir         string
+	timeout     time.Duration
+	retention   time.Duration
+
+	mu   sync.Mutex
+	runs map[string]*workflowRun
+}
+
+func newWorkflowEngine(c *Config) (*workflowEngine, error) {
+	timeout, err := getEnvDuration("WORKFLOW_TIMEOUT", WORKFLOW_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+	retention, err := getEnvDuration("WORKFLOW_RETENTION", WORKFLOW_RETENTION)
+	if err != nil {
+		return nil, err
+	}
+	definitions, err := loadWorkflowDefinitions(getEnv("WORKFLOW_DIR", WORKFLOW_DIR))
+	if err != nil {
+		return nil, err
+	}
+	e := &workflowEngine{
+		c:           c,
+		definitions: definitions,
+		dir:         getEnv("WORKFLOW_STATE_DIR", WORKFLOW_STATE_DIR),
+		timeout:     timeout,
+		retention:   retention,
+		runs:        make(map[string]*workflowRun),
+	}
+	if err := os.MkdirAll(e.dir, 0o755); err != nil {
+		return nil, err
+	}
+	return e, e.load()
+}
+
+func loadWorkflowDefinitions(dir string) (map[string]workflowDefinition, error) {
+	definitions := make(map[string]workflowDefinition)
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		var def workflowDefinition
+		if err := json.Unmarshal(data, &def); err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		if err := def.validate(); err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		if _, ok := definitions[def.Name]; ok {
+			return nil, fmt.Errorf("%s: workflow %s is defined twice", file, def.Name)
+		}
+		definitions[def.Name] = def
+	}
+	return definitions, nil
+}
+
+func (def workflowDefinition) validate() error {
+	if def.Name == "" {
+		return errors.New("workflow name is required")
+	}
+	if len(def.Steps) == 0 {
+		return errors.New("workflow has no steps")
+	}
+	known := func(action string) bool {
+		return action == Authorization || action == Logging || action == Send
+	}
+	names := make(map[string]bool)
+	for _, step := range def.Steps {
+		if step.Name == "" || names[step.Name] {
+			return fmt.Errorf("step names must be set and unique, got %q", step.Name)
+		}
+		names[step.Name] = true
+		if !known(step.Action) {
+			return fmt.Errorf("step %s: unknown action %q", step.Name, step.Action)
+		}
+		if step.Compensate != nil && !known(step.Compensate.Action) {
+			return fmt.Errorf("step %s: unknown compensation action %q", step.Name, step.Compensate.Action)
+		}
+	}
+	return nil
+}
+
+// load reads the persisted runs and resumes the unfinished ones, unless
+// they need the credentials that weren't saved.
+func (e *workflowEngine) load() error {
+	// the resumed runs wait for the lock until every run is loaded
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	files, err := filepath.Glob(filepath.Join(e.dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		var run workflowRun
+		if err := json.Unmarshal(data, &run); err != nil {
+			log.Printf("workflow: skipping unreadable run %s: %v\n", file, err)
+			continue
+		}
+		e.runs[run.ID] = &run
+		if !run.finished() {
+			if _, ok := e.definitions[run.Workflow]; !ok {
+				log.Printf("workflow: run %s references unknown workflow %s\n", run.ID, run.Workflow)
+				continue
+			}
+			if run.CredentialsOmitted {
+				log.Printf("workflow: failing run %s of %s, its credentials weren't kept\n", run.ID, run.Workflow)
+				run.Status = runFailed
+				run.Error = errCredentialsLost.Error()
+				run.UpdatedAt = time.Now().UTC()
+				if err := e.save(&run); err != nil {
+					return err
+				}
+				continue
+			}
+			log.Printf("workflow: resuming run %s of %s\n", run.ID, run.Workflow)
+			go e.execute(run.ID)
+		}
+	}
+	e.prune()
+	return nil
+}
+
+// prune drops the finished runs older than the retention window, in
+// memory and on disk. Must be called with e.mu held.
+func (e *workflowEngine) prune() {
+	cutoff := time.Now().Add(-e.retention)
+	for id, run := range e.runs {
+		if !run.finished() || !run.UpdatedAt.Before(cutoff) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(e.dir, id+".json")); err != nil && !os.IsNotExist(err) {
+			log.Printf("workflow: failed to remove run %s: %v\n", id, err)
+			continue
+		}
+		delete(e.runs, id)
+	}
+}
+
+func (e *workflowEngine) start(name string, input map[string]any) (workflowRun, error) {
+	def, ok := e.definitions[name]
+	if !ok {
+		return workflowRun{}, errWorkflowNotFound
+	}
+	now := time.Now().UTC()
+	run := &workflowRun{
+		ID:        newID(),
+		Workflow:  name,
+		Status:    runRunning,
+		Input:     input,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	for _, step := range def.Steps {
+		run.Steps = append(run.Steps, stepState{Name: step.Name, Status: stepPending})
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.prune()
+	if err := e.save(run); err != nil {
+		return workflowRun{}, err
+	}
+	e.runs[run.ID] = run
+	go e.execute(run.ID)
+	return e.snapshot(run), nil
+}
+
+func (e *workflowEngine) get(id string) (workflowRun, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	run, ok := e.runs[id]
+	if !ok {
+		return workflowRun{}, false
+	}
+	return e.snapshot(run), true
+}
+
+// snapshot copies run so it can be used without holding e.mu.
+func (e *workflowEngine) snapshot(run *workflowRun) workflowRun {
+	copied := *run
+	copied.Steps = append([]stepState(nil), run.Steps...)
+	return copied
+}
+
+// update applies change to the run and persists it.
+func (e *workflowEngine) update(id string, change func(run *workflowRun)) workflowRun {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	run := e.runs[id]
+	change(run)
+	run.UpdatedAt = time.Now().UTC()
+	if err := e.save(run); err != nil {
+		log.Printf("workflow: failed to persist run %s: %v\n", id, err)
+	}
+	return e.snapshot(run)
+}
+
+// save must be called with e.mu held.
+func (e *workflowEngine) save(run *workflowRun) error {
+	persisted := *run
+	persisted.Input, _ = withoutCredentials(run.Input).(map[string]any)
+	persisted.CredentialsOmitted = run.CredentialsOmitted || !reflect.DeepEqual(persisted.Input, run.Input)
+	data, err := json.Marshal(persisted)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(e.dir, run.ID+".json.tmp")
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(e.dir, run.ID+".json"))
+}
+
+// execute runs the pending steps of a run in order, and compensates the
+// succeeded ones in reverse order when a step fails.
+func (e *workflowEngine) execute(id string) {
+	run, _ := e.get(id)
+	def := e.definitions[run.Workflow]
+
+	if run.Status == runRunning {
+		for i, step := range def.Steps {
+			if run.Steps[i].Status == stepSucceeded {
+				continue
+			}
+			payload, err := e.runStep(run, step.Action, step.Request)
+			run = e.update(id, func(run *workflowRun) {
+				if err != nil {
+					run.Steps[i].Status = stepFailed
+					run.Steps[i].Error = err.Error()
+					run.Status = runCompensating
+					run.Error = fmt.Sprintf("step %s failed: %v", step.Name, err)
+					return
+				}
+				run.Steps[i].Status = stepSucceeded
+				run.Steps[i].Message = payload.Message
+				run.Steps[i].Data = payload.Data
+			})
+			if err != nil {
+				break
+			}
+		}
+		if run.Status == runRunning {
+			e.update(id, func(run *workflowRun) { run.Status = runSucceeded })
+			return
+		}
+	}
+
+	failed := false
+	for i := len(def.Steps) - 1; i >= 0; i-- {
+		step := def.Steps[i]
+		if run.Steps[i].Status != stepSucceeded || step.Compensate == nil {
+			continue
+		}
+		_, err := e.runStep(run, step.Compensate.Action, step.Compensate.Request)
+		run = e.update(id, func(run *workflowRun) {
+			if err != nil {
+				run.Steps[i].Status = stepCompensationFailed
+				run.Steps[i].Error = err.Error()
+				return
+			}
+			run.Steps[i].Status = stepCompensated
+		})
+		if err != nil {
+			failed = true
+		}
+	}
+	e.update(id, func(run *workflowRun) {
+		run.Status = runCompensated
+		if failed {
+			run.Status = runFailed
+		}
+	})
+}
+
+func (e *workflowEngine) runStep(run workflowRun, action string, template json.RawMessage) (jsonResponse, error) {
+	request, err := renderStepRequest(run, action, template)
+	if err != nil {
+		return jsonResponse{}, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), e.timeout)
+	defer cancel()
+	return e.c.runAction(ctx, request)
+}
+
+var templateExpr = regexp.MustCompile(`\{\{\s*([\w.\-]+)\s*\}\}`)
+
+// renderStepRequest fills the {{...}} references in template from the
+// run and decodes the result as a request for action.
+func renderStepRequest(run workflowRun, action string, template json.RawMessage) (requestType, error) {
+	var request requestType
+	steps := make(map[string]any, len(run.Steps))
+	for _, step := range run.Steps {
+		steps[step.Name] = map[string]any{"message": step.Message, "data": step.Data}
+	}
+	scope := map[string]any{
+		"input": run.Input,
+		"steps": steps,
+		"run":   map[string]any{"id": run.ID, "workflow": run.Workflow},
+	}
+
+	var tree any
+	if len(template) > 0 {
+		if err := json.Unmarshal(template, &tree); err != nil {
+			return request, err
+		}
+	}
+	rendered, err := json.Marshal(renderValue(tree, scope))
+	if err != nil {
+		return request, err
+	}
+	if err := json.Unmarshal(rendered, &request); err != nil {
+		return request, err
+	}
+	request.Action = action
+	return request, nil
+}
+
+// withoutCredentials returns a copy of v without the credentialFields,
+// at any depth.
+func withoutCredentials(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		out := make(map[string]any, len(v))
+		for k, item := range v {
+			if !credentialFields[strings.ToLower(k)] {
+				out[k] = withoutCredentials(item)
+			}
+		}
+		return out
+	case []any:
+		out := make([]any, len(v))
+		for i, item := range v {
+			out[i] = withoutCredentials(item)
+		}
+		return out
+	}
+	return v
+}
+
+func renderValue(v any, scope map[string]any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		out := make(map[string]any, len(v))
+		for k, item := range v {
+			out[k] = renderValue(item, scope)
+		}
+		return out
+	case []any:
+		out := make([]any, len(v))
+		for i, item := range v {
+			out[i] = renderValue(item, scope)
+		}
+		return out
+	case string:
+		// a lone reference keeps the type of the referenced value
+		if m := templateExpr.FindStringSubmatch(v); m != nil && m[0] == v {
+			return lookupPath(scope, m[1])
+		}
+		return templateExpr.ReplaceAllStringFunc(v, func(expr string) string {
+			value := lookupPath(scope, templateExpr.FindStringSubmatch(expr)[1])
+			if value == nil {
+				return ""
+			}
+			if s, ok := value.(string); ok {
+				return s
+			}
+			b, _ := json.Marshal(value)
+			return string(b)
+		})
+	}
+	return v
+}
+
+func lookupPath(scope map[string]any, path string) any {
+	var current any = scope
+	for _, key := range strings.Split(path, ".") {
+		m, ok := current.(map[string]any)
+		if !ok {
+			return nil
+		}
+		current = m[key]
+	}
+	return current
+}
+
+func (c *Config) listWorkflows(w http.ResponseWriter, r *http.Request) {
+	definitions := make([]workflowDefinition, 0, len(c.workflows.definitions))
+	for _, def := range c.workflows.definitions {
+		definitions = append(definitions, def)
+	}
+	sort.Slice(definitions, func(a, b int) bool {
+		return definitions[a].Name < definitions[b].Name
+	})
+	response := jsonResponse{
+		Error:   false,
+		Message: "Workflows",
+		Data:    definitions,
+	}
+	c.writeJSON(w, http.StatusOK, response)
+}
+
+func (c *Config) startWorkflow(w http.ResponseWriter, r *http.Request) {
+	input := map[string]any{}
+	if r.ContentLength != 0 {
+		if err := c.readJSON(w, r, &input); err != nil {
+			c.ErrorJSON(w, err)
+			return
+		}
+	}
+	run, err := c.workflows.start(chi.URLParam(r, "name"), input)
+	if errors.Is(err, errWorkflowNotFound) {
+		c.ErrorJSON(w, err, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Println("workflow: failed to persist run:", err)
+		c.ErrorJSON(w, errors.New("Workflow could not be started"), http.StatusInternalServerError)
+		return
+	}
+	response := jsonResponse{
+		Error:   false,
+		Message: "Workflow started",
+		Data:    redactAs(c.redactor, stageTrace, run),
+	}
+	headers := http.Header{}
+	headers.Set("Location", "/workflows/runs/"+run.ID)
+	c.writeJSON(w, http.StatusAccepted, response, headers)
+}
+
+func (c *Config) getWorkflowRun(w http.ResponseWriter, r *http.Request) {
+	run, ok := c.workflows.get(chi.URLParam(r, "id"))
+	if !ok {
+		c.ErrorJSON(w, errors.New("Workflow run not found"), http.StatusNotFound)
+		return
+	}
+	response := jsonResponse{
+		Error:   false,
+		Message: "Workflow " + run.Status,
+		Data:    redactAs(c.redactor, stageTrace, run),
+	}
+	c.writeJSON(w, http.StatusOK, response)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWithoutCredentials(t *testing.T) {
+	tests := []struct {
+		name string
+		in   any
+		want any
+	}{
+		{"flat", map[string]any{"email": "a@example.com", "password": "hunter2"}, map[string]any{"email": "a@example.com"}},
+		{"any case", map[string]any{"Token": "t", "SECRET": "s", "name": "n"}, map[string]any{"name": "n"}},
+		{"nested", map[string]any{"auth": map[string]any{"authorization": "Bearer x", "user": "u"}}, map[string]any{"auth": map[string]any{"user": "u"}}},
+		{"in lists", map[string]any{"users": []any{map[string]any{"password": "p", "id": 1.0}}}, map[string]any{"users": []any{map[string]any{"id": 1.0}}}},
+		{"scalars", "password", "password"},
+	}
+	for _, tt := range tests {
+		if got := withoutCredentials(tt.in); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestWorkflowSaveLeavesOutCredentials(t *testing.T) {
+	e := &workflowEngine{dir: t.TempDir(), runs: make(map[string]*workflowRun)}
+	run := &workflowRun{ID: "run", Input: map[string]any{"email": "a@example.com", "password": "hunter2"}}
+	if err := e.save(run); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(e.dir, "run.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "hunter2") {
+		t.Errorf("password persisted: %s", data)
+	}
+	if run.Input["password"] != "hunter2" {
+		t.Error("password removed from the run in memory")
+	}
+}
+
+func TestWorkflowLoadFailsRunsWithoutCredentials(t *testing.T) {
+	dir := t.TempDir()
+	saved := &workflowEngine{dir: dir, runs: make(map[string]*workflowRun)}
+	runs := []*workflowRun{
+		{ID: "with", Workflow: "signup", Status: runRunning, Input: map[string]any{"email": "a@example.com", "password": "hunter2"}},
+		{ID: "without", Workflow: "signup", Status: runFailed, Input: map[string]any{"email": "a@example.com"}, UpdatedAt: time.Now()},
+	}
+	for _, run := range runs {
+		if err := saved.save(run); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	e := &workflowEngine{
+		dir:         dir,
+		definitions: map[string]workflowDefinition{"signup": {}},
+		retention:   time.Hour,
+		runs:        make(map[string]*workflowRun),
+	}
+	if err := e.load(); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		id         string
+		wantStatus string
+		wantError  string
+	}{
+		{"with", runFailed, errCredentialsLost.Error()},
+		{"without", runFailed, ""},
+	}
+	for _, tt := range tests {
+		run, ok := e.get(tt.id)
+		if !ok || run.Status != tt.wantStatus || run.Error != tt.wantError {
+			t.Errorf("%s: got %+v", tt.id, run)
+		}
+	}
+}
+
+func TestWorkflowPrune(t *testing.T) {
+	e := &workflowEngine{dir: t.TempDir(), retention: time.Hour, runs: make(map[string]*workflowRun)}
+	old := time.Now().Add(-2 * time.Hour)
+	tests := []struct {
+		run      *workflowRun
+		wantKept bool
+	}{
+		{&workflowRun{ID: "old-succeeded", Status: runSucceeded, UpdatedAt: old}, false},
+		{&workflowRun{ID: "old-failed", Status: runFailed, UpdatedAt: old}, false},
+		{&workflowRun{ID: "old-running", Status: runRunning, UpdatedAt: old}, true},
+		{&workflowRun{ID: "recent", Status: runSucceeded, UpdatedAt: time.Now()}, true},
+	}
+	for _, tt := range tests {
+		e.runs[tt.run.ID] = tt.run
+		if err := e.save(tt.run); err != nil {
+			t.Fatal(err)
+		}
+	}
+	e.prune()
+	for _, tt := range tests {
+		_, kept := e.runs[tt.run.ID]
+		_, err := os.Stat(filepath.Join(e.dir, tt.run.ID+".json"))
+		if kept != tt.wantKept || (err == nil) != tt.wantKept {
+			t.Errorf("%s: kept %v, file error %v, want kept %v", tt.run.ID, kept, err, tt.wantKept)
+		}
+	}
+}